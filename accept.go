@@ -0,0 +1,39 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// Matches an AcceptError the OS reports as temporary, such as running out of
+// file descriptors. Any other AcceptError is permanent
+var ErrTemporaryAccept = errors.New("temporary accept error")
+
+// Failure to accept a connection on the listener
+type AcceptError struct {
+	// Address of the listener
+	Addr net.Addr
+	Err  error
+}
+
+func (e *AcceptError) Error() string {
+	if e.Addr == nil {
+		return "accept: " + e.Err.Error()
+	}
+	return "accept on " + e.Addr.String() + ": " + e.Err.Error()
+}
+
+func (e *AcceptError) Unwrap() error {
+	return e.Err
+}
+
+// Reports whether retrying the accept may succeed
+func (e *AcceptError) Temporary() bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(e.Err, &ne) && ne.Temporary()
+}
+
+// Makes errors.Is(err, ErrTemporaryAccept) hold for temporary errors
+func (e *AcceptError) Is(target error) bool {
+	return target == ErrTemporaryAccept && e.Temporary()
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// Error that reports itself as temporary, as EMFILE does
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Temporary() bool { return true }
+
+func TestAcceptError(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	cause := errors.New("listener broke")
+	err := error(&AcceptError{Addr: addr, Err: cause})
+	if got, want := err.Error(), "accept on 127.0.0.1:80: listener broke"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("AcceptError doesn't unwrap to its cause")
+	}
+	if errors.Is(err, ErrTemporaryAccept) {
+		t.Error("permanent error matches ErrTemporaryAccept")
+	}
+
+	temp := &AcceptError{Err: &net.OpError{Op: "accept", Net: "tcp", Err: temporaryError{}}}
+	if !temp.Temporary() || !errors.Is(temp, ErrTemporaryAccept) {
+		t.Error("temporary error not reported as temporary")
+	}
+	if got, want := temp.Error(), "accept: accept tcp: too many open files"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestAcceptErrorHandler(t *testing.T) {
+	var got *AcceptError
+	s, err := New(WithAcceptErrorHandler(func(err *AcceptError) { got = err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	want := s.acceptFailed(addr, errors.New("listener broke"))
+	if got != want || got.Addr != addr {
+		t.Errorf("handler received %v, want %v", got, want)
+	}
+	if n := s.Stats().AcceptErrors; n != 1 {
+		t.Errorf("AcceptErrors = %d, want 1", n)
+	}
+	if _, err := New(WithAcceptErrorHandler(nil)); err == nil {
+		t.Error("New accepted a nil accept error handler")
+	}
+}
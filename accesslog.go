@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// One connection as seen by the access log. Duration and the byte counts
+// cover the time up to when the record is taken
+type AccessRecord struct {
+	ClientAddr   net.Addr
+	Start        time.Time
+	Duration     time.Duration
+	BytesRead    int64
+	BytesWritten int64
+	// Error a framing helper stopped with, nil otherwise
+	Err error
+}
+
+// Returns the record of a connection handed to a handler or middleware, so far.
+// ok is false for connections that don't come from a Server
+func ConnRecord(c tcpserver.Connection) (rec AccessRecord, ok bool) {
+	wc, ok := c.(*conn)
+	if !ok {
+		return AccessRecord{}, false
+	}
+	return wc.record(), true
+}
+
+// Formatter used when WithAccessLog is given none:
+// start time, client address, byte counts, duration and error if any
+func DefaultAccessFormat(rec AccessRecord) string {
+	line := fmt.Sprintf("%s %s read=%d written=%d duration=%s",
+		rec.Start.Format(time.RFC3339), rec.ClientAddr, rec.BytesRead, rec.BytesWritten, rec.Duration)
+	if rec.Err != nil {
+		line += fmt.Sprintf(" error=%q", rec.Err.Error())
+	}
+	return line
+}
+
+// Writes one formatted line per closed connection
+type accessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(rec AccessRecord) string
+}
+
+func (l *accessLog) log(rec AccessRecord) {
+	line := l.format(rec)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Waits up to a second for the access log to hold n lines
+func accessLines(t *testing.T, logs *logBuffer, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		lines := strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+		if len(lines) >= n && lines[0] != "" {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("access log %q, want %d lines", logs.String(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	logs := &logBuffer{}
+	s := startServer(t, WithAccessLog(logs, nil), WithRequestHandler(func(conn tcpserver.Connection) {
+		if _, err := ReadExactly(conn, 4); err == nil {
+			conn.Write([]byte("pong"))
+		}
+	}))
+	conn := dial(t, s.Addr())
+	conn.Write([]byte("ping"))
+	readAll(t, conn)
+	line := accessLines(t, logs, 1)[0]
+	if !strings.Contains(line, " "+conn.LocalAddr().String()+" read=4 written=4 duration=") {
+		t.Errorf("access log line %q", line)
+	}
+
+	logs = &logBuffer{}
+	s = startServer(t, WithAccessLog(logs, func(rec AccessRecord) string {
+		return "err=" + rec.Err.Error()
+	}), WithRequestHandler(LineHandler(4, func(conn tcpserver.Connection, line []byte) error { return nil })))
+	conn = dial(t, s.Addr())
+	conn.Write([]byte("too long\n"))
+	readAll(t, conn)
+	if got := accessLines(t, logs, 1); !strings.HasPrefix(got[0], "err="+ErrLineTooLong.Error()) {
+		t.Errorf("access log %q, want the framing error", got)
+	}
+
+	if _, err := New(WithAccessLog(nil, nil)); err == nil {
+		t.Error("New accepted a nil access log writer")
+	}
+}
+
+func TestDefaultAccessFormat(t *testing.T) {
+	rec := AccessRecord{
+		ClientAddr:   &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000},
+		Start:        time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:     1500 * time.Millisecond,
+		BytesRead:    10,
+		BytesWritten: 20,
+	}
+	want := "2024-01-02T03:04:05Z 10.0.0.1:4000 read=10 written=20 duration=1.5s"
+	if got := DefaultAccessFormat(rec); got != want {
+		t.Errorf("DefaultAccessFormat = %q, want %q", got, want)
+	}
+	rec.Err = errors.New("boom")
+	if got := DefaultAccessFormat(rec); got != want+` error="boom"` {
+		t.Errorf("DefaultAccessFormat with an error = %q", got)
+	}
+	if _, ok := ConnRecord(NewFakeConn()); ok {
+		t.Error("ConnRecord reported a record for a connection not from a Server")
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// HTTP listener for metrics and health probes, next to the data port
+type adminServer struct {
+	addr string
+	srv  *http.Server
+	ln   net.Listener
+}
+
+func (s *Server) newAdminServer(addr string, withPprof bool) *adminServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, s.Stats())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "OK\n")
+	})
+	if withPprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return &adminServer{
+		addr: addr,
+		srv:  &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second},
+	}
+}
+
+func (a *adminServer) listen(log *slog.Logger) error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return fmt.Errorf("error listening on admin interface: %w", err)
+	}
+	a.ln = ln
+	log.Info("admin listening", "addr", ln.Addr().String())
+	go func() {
+		if err := a.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("admin server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (a *adminServer) close() {
+	a.srv.Close()
+}
+
+// Renders the counters in the Prometheus text exposition format
+func writeMetrics(w io.Writer, st Stats) {
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("tcpserver_connections_active", "gauge", "Connections whose handler is running.", st.ActiveConnections)
+	metric("tcpserver_connections_accepted_total", "counter", "Connections accepted.", st.TotalAccepted)
+	metric("tcpserver_read_bytes_total", "counter", "Bytes read by handlers.", st.TotalBytesRead)
+	metric("tcpserver_written_bytes_total", "counter", "Bytes written by handlers.", st.TotalBytesWritten)
+	metric("tcpserver_accept_errors_total", "counter", "Failures that stopped the accept loop.", st.AcceptErrors)
+	metric("tcpserver_handler_panics_total", "counter", "Handler panics caught.", st.HandlerPanics)
+}
+
+// Returns the address the admin listener is bound to, nil without
+// WithAdminListener or until the server is started
+func (s *Server) AdminAddr() net.Addr {
+	if s.admin == nil || s.admin.ln == nil {
+		return nil
+	}
+	return s.admin.ln.Addr()
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fetches path from the admin listener and returns the status and body
+func adminGet(t *testing.T, s *Server, path string) (int, string) {
+	t.Helper()
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + s.AdminAddr().String() + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestAdminListener(t *testing.T) {
+	s, err := New(WithAdminListener("127.0.0.1:0"), WithRequestHandler(reply("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.AdminAddr() != nil {
+		t.Error("AdminAddr set before Start")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(time.Second) })
+
+	readAll(t, dial(t, s.Addr()))
+	if code, body := adminGet(t, s, "/healthz"); code != http.StatusOK || body != "OK\n" {
+		t.Errorf("GET /healthz = %d %q", code, body)
+	}
+	code, body := adminGet(t, s, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("GET /metrics = %d", code)
+	}
+	for _, want := range []string{
+		"# TYPE tcpserver_connections_accepted_total counter\ntcpserver_connections_accepted_total 1\n",
+		"tcpserver_written_bytes_total 5\n",
+		"tcpserver_connections_active 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+
+	addr := s.AdminAddr().String()
+	s.Stop(time.Second)
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Error("admin listener still serving after Stop")
+	}
+
+	if _, err := New(WithAdminListener("9100")); err == nil {
+		t.Error("New accepted an admin address without a port")
+	}
+}
+
+func TestPprof(t *testing.T) {
+	for _, enable := range []bool{true, false} {
+		s := startServer(t, WithAdminListener("127.0.0.1:0"), WithPprof(enable))
+		code, body := adminGet(t, s, "/debug/pprof/")
+		if enable && (code != http.StatusOK || !strings.Contains(body, "goroutine")) {
+			t.Errorf("GET /debug/pprof/ = %d with pprof enabled", code)
+		}
+		if !enable && code != http.StatusNotFound {
+			t.Errorf("GET /debug/pprof/ = %d with pprof disabled, want 404", code)
+		}
+	}
+	if _, err := New(WithPprof(true)); err == nil {
+		t.Error("New enabled pprof without an admin listener")
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Serves a certificate from disk, reloading it whenever the files change
+type certReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+	cert     atomic.Pointer[tls.Certificate]
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+func newCertReloader(certPath, keyPath string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath, interval: interval}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate callback handing out the current certificate
+func (r *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Polls the files until stop is closed. A failed reload keeps the previous
+// certificate and is retried on the next check
+func (r *certReloader) run(log *slog.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := r.changed()
+			if err == nil && changed {
+				err = r.reload()
+				if err == nil {
+					log.Info("reloaded tls certificate", "cert", r.certPath)
+				}
+			}
+			if err != nil {
+				log.Error("reload tls certificate", "cert", r.certPath, "error", err)
+			}
+		}
+	}
+}
+
+func (r *certReloader) changed() (bool, error) {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return false, err
+	}
+	return !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod), nil
+}
+
+func (r *certReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("load tls key pair: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.certMod, r.keyMod = certMod, keyMod
+	return nil
+}
+
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	ci, err := os.Stat(r.certPath)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	ki, err := os.Stat(r.keyPath)
+	if err != nil {
+		return certMod, keyMod, err
+	}
+	return ci.ModTime(), ki.ModTime(), nil
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+// Returns the common name of the certificate the server hands out
+func servedName(t *testing.T, s *Server) string {
+	t.Helper()
+	conn, err := dialTLS(t, s.Addr(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// Moves the modification time of the files later by d, so a rewrite within
+// the file system's timestamp granularity still counts as a change
+func touch(t *testing.T, d time.Duration, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		mod := time.Now().Add(d)
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	certPath, keyPath := writeCertFiles(t, testCert(t, "first"))
+	s := startServer(t, WithCertReloader(certPath, keyPath, 10*time.Millisecond), WithRequestHandler(reply("hello")))
+	if got := servedName(t, s); got != "first" {
+		t.Fatalf("served %q, want first", got)
+	}
+
+	// a half-written file keeps the previous certificate
+	if err := os.WriteFile(certPath, []byte("-----BEGIN CERT"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, time.Second, certPath)
+	time.Sleep(50 * time.Millisecond)
+	if got := servedName(t, s); got != "first" {
+		t.Fatalf("served %q after a broken rewrite, want first", got)
+	}
+
+	writeCert(t, testCert(t, "second"), certPath, keyPath)
+	touch(t, 2*time.Second, certPath, keyPath)
+	deadline := time.Now().Add(time.Second)
+	for servedName(t, s) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate never served")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := New(WithCertReloader(certPath, keyPath, 0)); err == nil {
+		t.Error("New accepted a check interval of 0")
+	}
+}
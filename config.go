@@ -0,0 +1,76 @@
+package server
+
+import (
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Plain configuration mirroring the With* options, handy when loading settings
+// from files or the environment. Zero values leave the corresponding default
+type Config struct {
+	Host                   string
+	Port                   int
+	SocketReusePort        bool
+	SocketFastOpen         bool
+	SocketFastOpenQueueLen int
+	SocketDeferAccept      bool
+	Loops                  int
+	WorkerpoolShards       int
+	AllowThreadLocking     bool
+	BallastMiB             int
+	MaxAcceptConnections   int
+	MaxConnectionsPerIP    int
+	ReadTimeout            time.Duration
+	WriteTimeout           time.Duration
+	IdleTimeout            time.Duration
+	TLSCertFile            string
+	TLSKeyFile             string
+}
+
+// Creates a server from a plain Config, translating it to the equivalent options
+func NewWithConfig(cfg Config, handler tcpserver.RequestHandlerFunc) (*Server, error) {
+	return New(append(cfg.options(), WithRequestHandler(handler))...)
+}
+
+func (cfg Config) options() []Option {
+	opts := []Option{
+		WithHost(cfg.Host),
+		WithPort(cfg.Port),
+		WithSocketReusePort(cfg.SocketReusePort),
+		WithSocketFastOpen(cfg.SocketFastOpen),
+		WithSocketDeferAccept(cfg.SocketDeferAccept),
+		WithAllowThreadLocking(cfg.AllowThreadLocking),
+	}
+	if cfg.SocketFastOpenQueueLen != 0 {
+		opts = append(opts, WithSocketFastOpenQueueLen(cfg.SocketFastOpenQueueLen))
+	}
+	if cfg.Loops != 0 {
+		opts = append(opts, WithLoops(cfg.Loops))
+	}
+	if cfg.WorkerpoolShards != 0 {
+		opts = append(opts, WithWorkerpoolShards(cfg.WorkerpoolShards))
+	}
+	if cfg.BallastMiB != 0 {
+		opts = append(opts, WithBallast(cfg.BallastMiB))
+	}
+	if cfg.MaxAcceptConnections != 0 {
+		opts = append(opts, WithMaxAcceptConnections(cfg.MaxAcceptConnections))
+	}
+	if cfg.MaxConnectionsPerIP != 0 {
+		opts = append(opts, WithMaxConnectionsPerIP(cfg.MaxConnectionsPerIP))
+	}
+	if cfg.ReadTimeout != 0 {
+		opts = append(opts, WithReadTimeout(cfg.ReadTimeout))
+	}
+	if cfg.WriteTimeout != 0 {
+		opts = append(opts, WithWriteTimeout(cfg.WriteTimeout))
+	}
+	if cfg.IdleTimeout != 0 {
+		opts = append(opts, WithIdleTimeout(cfg.IdleTimeout))
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		opts = append(opts, WithTLSFromFiles(cfg.TLSCertFile, cfg.TLSKeyFile))
+	}
+	return opts
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewWithConfig(t *testing.T) {
+	s, err := NewWithConfig(Config{
+		Host:                "127.0.0.1",
+		SocketReusePort:     true,
+		MaxConnectionsPerIP: 4,
+		ReadTimeout:         time.Second,
+	}, reply("hello"))
+	if err != nil {
+		t.Fatalf("NewWithConfig: %v", err)
+	}
+	if !s.GetListenConfig().SocketReusePort {
+		t.Error("SocketReusePort not carried over")
+	}
+	if d := s.cc.Load().readTimeout; d != time.Second {
+		t.Errorf("read timeout %s, want 1s", d)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Stop(time.Second)
+	if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+}
+
+func TestNewWithConfigInvalid(t *testing.T) {
+	if _, err := NewWithConfig(Config{Port: 70000}, nil); err == nil {
+		t.Error("NewWithConfig accepted port 70000")
+	}
+	if _, err := NewWithConfig(Config{TLSCertFile: "cert.pem"}, nil); err == nil {
+		t.Error("NewWithConfig accepted a certificate without a key")
+	}
+}
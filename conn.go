@@ -0,0 +1,418 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"golang.org/x/time/rate"
+)
+
+// State of a connection as reported to the WithConnState callback
+type ConnState int32
+
+const (
+	// Accepted, the handler is about to run
+	StateNew ConnState = iota
+	// Bytes are flowing
+	StateActive
+	// Between messages. Only reported by code that knows the framing, such as
+	// the framing helpers
+	StateIdle
+	// The handler returned and the connection is being closed
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Per-connection I/O policies, applied by wrapping the accepted connection
+type connConfig struct {
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	stats          *counters
+	onState        func(conn tcpserver.Connection, state ConnState)
+	onError        func(conn tcpserver.Connection, err error)
+	readers        *sync.Pool
+	registry       *registry
+	greeting       []byte
+	maxMessageSize int
+	readRate       int
+	writeRate      int
+	globalWrite    *rate.Limiter
+	accessLog      *accessLog
+	firstByte      time.Duration
+	quickAck       bool
+	maxLifetime    time.Duration
+	writers        *sync.Pool
+}
+
+// Runs next on a connection that enforces the configured policies
+func (cfg *connConfig) serve(c tcpserver.Connection, next tcpserver.RequestHandlerFunc) {
+	wc := &conn{Connection: c, cfg: cfg, start: time.Now()}
+	if cfg.accessLog != nil {
+		defer func() {
+			cfg.accessLog.log(wc.record())
+		}()
+	}
+	if cfg.readRate > 0 {
+		wc.readLimit = rate.NewLimiter(rate.Limit(cfg.readRate), cfg.readRate)
+	}
+	if cfg.writeRate > 0 {
+		wc.writeLimit = rate.NewLimiter(rate.Limit(cfg.writeRate), cfg.writeRate)
+	}
+	if cfg.quickAck {
+		if tc, ok := tcpConn(c); ok {
+			wc.quickAck, _ = tc.SyscallConn()
+		}
+	}
+	cfg.registry.add(wc)
+	defer cfg.registry.remove(wc)
+	// the timers may fire after serve returns, when c already serves another client
+	socket := socketOf(c)
+	if cfg.idleTimeout > 0 {
+		wc.idle = time.AfterFunc(cfg.idleTimeout, func() {
+			socket.Close()
+		})
+		defer wc.idle.Stop()
+	}
+	if cfg.maxLifetime > 0 {
+		timer := time.AfterFunc(cfg.maxLifetime, func() {
+			socket.Close()
+		})
+		defer timer.Stop()
+	}
+	if cfg.onState != nil {
+		cfg.onState(wc, StateNew)
+		defer wc.setState(StateClosed)
+	}
+	if len(cfg.greeting) > 0 {
+		if _, err := wc.Write(cfg.greeting); err != nil {
+			return
+		}
+	}
+	if cfg.firstByte > 0 {
+		if err := wc.awaitFirstByte(cfg.firstByte); err != nil {
+			c.Close()
+			return
+		}
+	}
+	if cfg.writers != nil {
+		wc.acquireWriter(cfg.writers)
+		defer wc.releaseWriter(cfg.writers)
+	}
+	next(wc)
+}
+
+type conn struct {
+	tcpserver.Connection
+	cfg   *connConfig
+	start time.Time
+	idle  *time.Timer
+	state atomic.Int32
+	// bandwidth throttles, nil when unlimited
+	readLimit  *rate.Limiter
+	writeLimit *rate.Limiter
+	// socket to re-arm TCP_QUICKACK on after reads, nil when not enabled
+	quickAck syscall.RawConn
+	// bytes read ahead by peek, served before reading further
+	pending []byte
+	// traffic of this connection alone
+	read    atomic.Int64
+	written atomic.Int64
+	// error the framing helper stopped with
+	err error
+	// buffers writes under WithWriteBufferSize, nil when unbuffered. Set and
+	// cleared while holding wmu, which also guards the writer itself
+	wmu sync.Mutex
+	buf atomic.Pointer[bufio.Writer]
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	// the peer may be waiting for the buffered writes before it sends more
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	if c.cfg.readTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.cfg.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.readConn(b)
+}
+
+// Reads from the underlying connection and accounts for the bytes read
+func (c *conn) readConn(b []byte) (int, error) {
+	if c.readLimit != nil && len(b) > c.readLimit.Burst() {
+		b = b[:c.readLimit.Burst()]
+	}
+	n, err := c.Connection.Read(b)
+	if n > 0 {
+		c.cfg.stats.bytesRead.Add(int64(n))
+		c.read.Add(int64(n))
+		if c.quickAck != nil {
+			rearmQuickAck(c.quickAck)
+		}
+		c.touch()
+		if c.readLimit != nil {
+			// holds off the next read until the bytes are paid for
+			if werr := c.readLimit.WaitN(*c.GetContext(), n); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.buf.Load() == nil {
+		return c.write(b, c.cfg.writeTimeout)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// the handler may have returned meanwhile, taking the buffer along
+	if w := c.buf.Load(); w != nil {
+		return w.Write(b)
+	}
+	return c.write(b, c.cfg.writeTimeout)
+}
+
+// Writes b past the write buffer, after sending what it holds, for writes that
+// don't come from the handler such as Broadcast
+func (c *conn) writeDirect(b []byte, timeout time.Duration) (int, error) {
+	if c.buf.Load() != nil {
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		if w := c.buf.Load(); w != nil {
+			if err := w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return c.write(b, timeout)
+}
+
+// Sends the buffered writes, if any
+func (c *conn) flush() error {
+	if c.buf.Load() == nil {
+		return nil
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if w := c.buf.Load(); w != nil {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Starts buffering writes in a writer taken from pool
+func (c *conn) acquireWriter(pool *sync.Pool) {
+	w, ok := pool.Get().(*bufio.Writer)
+	if !ok {
+		w = bufio.NewWriterSize(nil, defaultWriteBufferSize)
+	}
+	w.Reset(connWriter{c})
+	c.wmu.Lock()
+	c.buf.Store(w)
+	c.wmu.Unlock()
+}
+
+// Flushes the buffered writes and puts the writer back. Later writes go out
+// unbuffered. A flush error is dropped, as the handler is done
+func (c *conn) releaseWriter(pool *sync.Pool) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	w := c.buf.Swap(nil)
+	w.Flush()
+	w.Reset(nil)
+	pool.Put(w)
+}
+
+// Writes to the connection past its write buffer
+type connWriter struct {
+	c *conn
+}
+
+func (w connWriter) Write(b []byte) (int, error) {
+	return w.c.write(b, w.c.cfg.writeTimeout)
+}
+
+// Waits up to d for the first byte and keeps it for the handler to read
+func (c *conn) awaitFirstByte(d time.Duration) error {
+	if err := c.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	n, err := c.readConn(buf)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return err
+	}
+	c.pending = buf
+	return c.SetReadDeadline(time.Time{})
+}
+
+// Reads ahead until n bytes are buffered or the peer closes, without consuming
+// them: later reads return them first
+func (c *conn) peek(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	read, err := io.ReadFull(c, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	c.pending = buf[:read]
+	return c.pending, err
+}
+
+// Reads ahead for as long as the input may still start with prefix, without
+// consuming anything. Reports whether it does, and no match when the input
+// hasn't decided it within wait
+func (c *conn) peekPrefix(prefix []byte, wait time.Duration) (bool, error) {
+	buf := append(make([]byte, 0, len(prefix)), c.pending...)
+	c.pending = nil
+	defer func() { c.pending = buf }()
+	// the peer may be waiting for the buffered writes before it sends more
+	if err := c.flush(); err != nil {
+		return false, err
+	}
+	if err := c.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return false, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+	for {
+		n := min(len(buf), len(prefix))
+		if !bytes.Equal(buf[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		read, err := c.readConn(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+read]
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Writes b under the given deadline instead of the configured one
+func (c *conn) write(b []byte, timeout time.Duration) (int, error) {
+	burst := c.writeBurst()
+	if burst == 0 {
+		return c.writeChunk(b, timeout)
+	}
+	// chunks of at most one burst, each getting its own deadline
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), burst)]
+		if err := c.waitWrite(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.writeChunk(chunk, timeout)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Largest write the throttles admit at once, 0 when writes aren't throttled
+func (c *conn) writeBurst() int {
+	burst := 0
+	for _, l := range []*rate.Limiter{c.writeLimit, c.cfg.globalWrite} {
+		if l != nil && (burst == 0 || l.Burst() < burst) {
+			burst = l.Burst()
+		}
+	}
+	return burst
+}
+
+// Waits until both the connection's and the server-wide throttle admit n bytes
+func (c *conn) waitWrite(n int) error {
+	ctx := *c.GetContext()
+	if c.writeLimit != nil {
+		if err := c.writeLimit.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	if c.cfg.globalWrite != nil {
+		return c.cfg.globalWrite.WaitN(ctx, n)
+	}
+	return nil
+}
+
+func (c *conn) writeChunk(b []byte, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Connection.Write(b)
+	if n > 0 {
+		c.cfg.stats.bytesWritten.Add(int64(n))
+		c.written.Add(int64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+// Snapshot of the connection for the access log
+func (c *conn) record() AccessRecord {
+	return AccessRecord{
+		ClientAddr:   c.RemoteAddr(),
+		Start:        c.start,
+		Duration:     time.Since(c.start),
+		BytesRead:    c.read.Load(),
+		BytesWritten: c.written.Load(),
+		Err:          c.err,
+	}
+}
+
+// Records activity, postponing the idle close
+func (c *conn) touch() {
+	if c.idle != nil {
+		c.idle.Reset(c.cfg.idleTimeout)
+	}
+	c.setState(StateActive)
+}
+
+// Reports a state transition, ignoring repeats of the current state
+func (c *conn) setState(state ConnState) {
+	if c.cfg.onState == nil {
+		return
+	}
+	if ConnState(c.state.Swap(int32(state))) != state {
+		c.cfg.onState(c, state)
+	}
+}
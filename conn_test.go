@@ -0,0 +1,260 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handler that reads until an error and hands the error to errs
+func readUntilError(errs chan<- error) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		b := make([]byte, 64)
+		for {
+			if _, err := conn.Read(b); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+}
+
+// Waits up to a second for the error a handler stopped with
+func handlerError(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(time.Second):
+		t.Fatal("handler still running")
+		return nil
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithReadTimeout(100*time.Millisecond), WithRequestHandler(readUntilError(errs)))
+	conn := dial(t, s.Addr())
+	// reads keep pushing the deadline out
+	for i := 0; i < 3; i++ {
+		conn.Write([]byte("x"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	begin := time.Now()
+	if err := handlerError(t, errs); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read failed with %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("silent client held for %s", elapsed)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithWriteTimeout(100*time.Millisecond), WithRequestHandler(func(conn tcpserver.Connection) {
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}))
+	// never reads, so the socket buffers fill up
+	dial(t, s.Addr())
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("write failed with %v, want a deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to a stalled client never timed out")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithIdleTimeout(100*time.Millisecond), WithRequestHandler(readUntilError(errs)))
+	conn := dial(t, s.Addr())
+	// traffic keeps resetting the idle timer
+	for i := 0; i < 4; i++ {
+		conn.Write([]byte("x"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("active connection closed: %v", err)
+	default:
+	}
+	handlerError(t, errs)
+	if got := readAll(t, conn); got != "" {
+		t.Fatalf("read %q from an idle connection", got)
+	}
+}
+
+func TestConnState(t *testing.T) {
+	states := make(chan ConnState, 8)
+	s := startServer(t,
+		WithConnState(func(conn tcpserver.Connection, state ConnState) {
+			states <- state
+		}),
+		WithRequestHandler(LineHandler(64, func(conn tcpserver.Connection, line []byte) error {
+			return nil
+		})),
+	)
+	conn := dial(t, s.Addr())
+	conn.Write([]byte("one\n"))
+	conn.(*net.TCPConn).CloseWrite()
+	readAll(t, conn)
+	for _, want := range []ConnState{StateNew, StateActive, StateIdle, StateClosed} {
+		select {
+		case got := <-states:
+			if got != want {
+				t.Fatalf("state %v, want %v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %v state", want)
+		}
+	}
+}
+
+func TestGreeting(t *testing.T) {
+	banner := []byte("220 ready\r\n")
+	s := startServer(t, WithGreeting(banner), WithRequestHandler(reply("ok")))
+	copy(banner, "500")
+	if got, want := readAll(t, dial(t, s.Addr())), "220 ready\r\nok"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	if _, err := New(WithGreeting(nil)); err == nil {
+		t.Error("New accepted an empty greeting")
+	}
+}
+
+// Reads everything the server sends and reports how long it took
+func timedRead(t *testing.T, conn net.Conn) (string, time.Duration) {
+	t.Helper()
+	begin := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b), time.Since(begin)
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	payload := strings.Repeat("x", 1500)
+	s := startServer(t, WithWriteRateLimit(1000), WithRequestHandler(reply(payload)))
+	// the first second's worth goes out right away, the rest half a second later
+	got, elapsed := timedRead(t, dial(t, s.Addr()))
+	if got != payload {
+		t.Fatalf("read %d bytes, want %d", len(got), len(payload))
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("1500 bytes at 1000 B/s took %v", elapsed)
+	}
+}
+
+func TestReadRateLimit(t *testing.T) {
+	s := startServer(t, WithReadRateLimit(1000), WithRequestHandler(func(conn tcpserver.Connection) {
+		begin := time.Now()
+		if _, err := ReadExactly(conn, 1500); err != nil {
+			return
+		}
+		conn.Write([]byte(time.Since(begin).Round(100 * time.Millisecond).String()))
+	}))
+	conn := dial(t, s.Addr())
+	conn.Write([]byte(strings.Repeat("x", 1500)))
+	got, _ := timedRead(t, conn)
+	if d, err := time.ParseDuration(got); err != nil || d < 400*time.Millisecond {
+		t.Errorf("reading 1500 bytes at 1000 B/s took %q", got)
+	}
+	for _, opt := range []Option{WithReadRateLimit(0), WithWriteRateLimit(0)} {
+		if _, err := New(opt); err == nil {
+			t.Error("New accepted a zero rate")
+		}
+	}
+}
+
+func TestGlobalWriteRateLimit(t *testing.T) {
+	payload := strings.Repeat("x", 750)
+	s := startServer(t, WithGlobalWriteRateLimit(1000), WithRequestHandler(reply(payload)))
+	// each connection on its own would fit the first second's budget, together they don't
+	conns := []net.Conn{dial(t, s.Addr()), dial(t, s.Addr())}
+	begin := time.Now()
+	for i, conn := range conns {
+		if got, _ := timedRead(t, conn); got != payload {
+			t.Fatalf("connection %d read %d bytes, want %d", i, len(got), len(payload))
+		}
+	}
+	if elapsed := time.Since(begin); elapsed < 400*time.Millisecond {
+		t.Errorf("1500 bytes in total at 1000 B/s took %v", elapsed)
+	}
+	if _, err := New(WithGlobalWriteRateLimit(0)); err == nil {
+		t.Error("New accepted a zero rate")
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	ran := make(chan struct{}, 1)
+	s := startServer(t, WithFirstByteTimeout(100*time.Millisecond), WithRequestHandler(func(conn tcpserver.Connection) {
+		ran <- struct{}{}
+	}))
+	conn := dial(t, s.Addr())
+	begin := time.Now()
+	readAll(t, conn)
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("idle connection held for %s", elapsed)
+	}
+	select {
+	case <-ran:
+		t.Fatal("handler ran without a first byte")
+	default:
+	}
+}
+
+func TestFirstByteTimeoutSlowHandler(t *testing.T) {
+	s := startServer(t, WithFirstByteTimeout(50*time.Millisecond), WithRequestHandler(func(conn tcpserver.Connection) {
+		// reads only after the timeout has passed
+		time.Sleep(150 * time.Millisecond)
+		b := make([]byte, 4)
+		n, _ := io.ReadFull(conn, b)
+		conn.Write(b[:n])
+	}))
+	conn := dial(t, s.Addr())
+	conn.Write([]byte("ping"))
+	if got := readAll(t, conn); got != "ping" {
+		t.Fatalf("read %q, want ping", got)
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithMaxConnectionLifetime(150*time.Millisecond), WithRequestHandler(readUntilError(errs)))
+	conn := dial(t, s.Addr())
+	begin := time.Now()
+	// activity doesn't postpone the close
+	go func() {
+		for range 20 {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	if err := handlerError(t, errs); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("handler read error %v, want net.ErrClosed", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Errorf("closed after %v, before the lifetime", elapsed)
+	}
+	if _, err := New(WithMaxConnectionLifetime(0)); err == nil {
+		t.Error("New accepted a zero lifetime")
+	}
+}
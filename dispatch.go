@@ -0,0 +1,31 @@
+package server
+
+import (
+	"github.com/maurice2k/tcpserver"
+)
+
+// Picks the handler for a connection from its first bytes
+type dispatcher struct {
+	sniffLen int
+	route    func(peek []byte) tcpserver.RequestHandlerFunc
+}
+
+// Peeks the first bytes and runs the routed handler, or fallback when route
+// returns nil. Connections that close or fail before sending anything are dropped
+func (d *dispatcher) handler(fallback tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(c tcpserver.Connection) {
+		wc, ok := c.(*conn)
+		if !ok {
+			return
+		}
+		peek, err := wc.peek(d.sniffLen)
+		if err != nil || len(peek) == 0 {
+			return
+		}
+		h := d.route(peek)
+		if h == nil {
+			h = fallback
+		}
+		h(wc)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestProtocolDispatch(t *testing.T) {
+	var built int
+	mw := func(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+		built++
+		return func(conn tcpserver.Connection) {
+			conn.Write([]byte("mw:"))
+			next(conn)
+		}
+	}
+	echo := func(conn tcpserver.Connection) {
+		b := make([]byte, 4)
+		n, _ := conn.Read(b)
+		conn.Write(b[:n])
+	}
+	s := startServer(t,
+		WithMiddleware(mw),
+		WithRequestHandler(reply("fallback")),
+		WithProtocolDispatch(4, func(peek []byte) tcpserver.RequestHandlerFunc {
+			if bytes.Equal(peek, []byte("ECHO")) {
+				return echo
+			}
+			return nil
+		}),
+	)
+	for _, tt := range []struct{ send, want string }{
+		{"ECHO", "mw:ECHO"},
+		{"QUIT", "mw:fallback"},
+		{"ECHO", "mw:ECHO"},
+	} {
+		conn := dial(t, s.Addr())
+		conn.Write([]byte(tt.send))
+		if got := readAll(t, conn); got != tt.want {
+			t.Fatalf("sent %q, read %q, want %q", tt.send, got, tt.want)
+		}
+	}
+	if built != 1 {
+		t.Fatalf("middleware built %d times, want 1", built)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Builds options from environment variables named <prefix>_<NAME>:
+//
+//	HOST, PORT, REUSEPORT, FASTOPEN, FASTOPEN_QUEUE_LEN, DEFER_ACCEPT,
+//	LOOPS, WORKERPOOL_SHARDS, THREAD_LOCKING, BALLAST_MIB
+//
+// Unset or empty variables are skipped. Invalid values, including ones the
+// option itself rejects, produce an error naming the offending variable
+func FromEnv(prefix string) ([]Option, error) {
+	env := envReader{prefix: prefix}
+	var opts []Option
+	add := func(name string, opt Option) error {
+		if err := env.check(name, opt); err != nil {
+			return err
+		}
+		opts = append(opts, opt)
+		return nil
+	}
+
+	if v, ok := env.lookup("HOST"); ok {
+		if err := add("HOST", WithHost(v)); err != nil {
+			return nil, err
+		}
+	}
+	ints := []struct {
+		name   string
+		option func(int) Option
+	}{
+		{"PORT", WithPort},
+		{"FASTOPEN_QUEUE_LEN", WithSocketFastOpenQueueLen},
+		{"LOOPS", WithLoops},
+		{"WORKERPOOL_SHARDS", WithWorkerpoolShards},
+		{"BALLAST_MIB", WithBallast},
+	}
+	for _, i := range ints {
+		n, ok, err := env.int(i.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := add(i.name, i.option(n)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	bools := []struct {
+		name   string
+		option func(bool) Option
+	}{
+		{"REUSEPORT", WithSocketReusePort},
+		{"FASTOPEN", WithSocketFastOpen},
+		{"DEFER_ACCEPT", WithSocketDeferAccept},
+		{"THREAD_LOCKING", WithAllowThreadLocking},
+	}
+	for _, b := range bools {
+		v, ok, err := env.bool(b.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := add(b.name, b.option(v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+type envReader struct {
+	prefix string
+}
+
+func (e envReader) key(name string) string {
+	if e.prefix == "" {
+		return name
+	}
+	return e.prefix + "_" + name
+}
+
+func (e envReader) lookup(name string) (string, bool) {
+	v, ok := os.LookupEnv(e.key(name))
+	return v, ok && v != ""
+}
+
+// Applies opt to scratch options, so the error of a value the option rejects
+// names the variable it came from
+func (e envReader) check(name string, opt Option) error {
+	if err := opt(&options{}); err != nil {
+		return fmt.Errorf("%s: %w", e.key(name), err)
+	}
+	return nil
+}
+
+func (e envReader) int(name string) (int, bool, error) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: invalid integer %q", e.key(name), v)
+	}
+	return n, true, nil
+}
+
+func (e envReader) bool(name string) (bool, bool, error) {
+	v, ok := e.lookup(name)
+	if !ok {
+		return false, false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, false, fmt.Errorf("%s: invalid boolean %q", e.key(name), v)
+	}
+	return b, true, nil
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("APP_HOST", "127.0.0.1")
+	t.Setenv("APP_PORT", "0")
+	t.Setenv("APP_REUSEPORT", "true")
+	opts, err := FromEnv("APP")
+	if err != nil {
+		t.Fatalf("FromEnv: %v", err)
+	}
+	if len(opts) != 3 {
+		t.Fatalf("%d options, want 3", len(opts))
+	}
+	if _, err := New(opts...); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+}
+
+func TestFromEnvInvalid(t *testing.T) {
+	tests := []struct{ key, value string }{
+		{"APP_PORT", "eighty"},
+		{"APP_PORT", "70000"},
+		{"APP_BALLAST_MIB", "0"},
+		{"APP_FASTOPEN_QUEUE_LEN", "-1"},
+		{"APP_FASTOPEN", "maybe"},
+		{"APP_HOST", "not an address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			t.Setenv(tt.key, tt.value)
+			_, err := FromEnv("APP")
+			if err == nil {
+				t.Fatal("FromEnv accepted the value")
+			}
+			if !strings.Contains(err.Error(), tt.key) {
+				t.Fatalf("error %q doesn't name %s", err, tt.key)
+			}
+		})
+	}
+}
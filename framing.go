@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+var (
+	// Returned when a peer announces a frame larger than allowed
+	ErrFrameTooLarge = errors.New("frame too large")
+	// Returned when a peer sends a line longer than allowed
+	ErrLineTooLong = errors.New("line too long")
+	// Returned when a netstring lacks its length, colon or trailing comma
+	ErrMalformedNetstring = errors.New("malformed netstring")
+	// Returned when a message exceeds the server-wide WithMaxMessageSize
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// Handler for protocols framing messages with a 4-byte big-endian length prefix.
+// fn is called once per frame until the peer closes the connection, fn returns
+// an error, or a frame is malformed. A frame larger than maxFrame or a truncated
+// length prefix closes the connection. maxFrame must be greater than zero
+func LengthPrefixedHandler(maxFrame int, fn func(conn tcpserver.Connection, frame []byte) error) tcpserver.RequestHandlerFunc {
+	if maxFrame <= 0 {
+		panic("server: maxFrame must be greater than zero")
+	}
+	return func(conn tcpserver.Connection) {
+		reportError(conn, readLengthPrefixed(conn, maxFrame, fn))
+	}
+}
+
+func readLengthPrefixed(conn tcpserver.Connection, maxFrame int, fn func(conn tcpserver.Connection, frame []byte) error) error {
+	maxFrame, errTooLarge := messageLimit(conn, maxFrame, ErrFrameTooLarge)
+	r, release := acquireReader(conn)
+	defer release()
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("read frame length: %w", err)
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if uint64(size) > uint64(maxFrame) {
+			return fmt.Errorf("%w: %d bytes exceeds limit of %d", errTooLarge, size, maxFrame)
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return fmt.Errorf("read frame: %w", err)
+		}
+		if err := fn(conn, frame); err != nil {
+			return err
+		}
+		markIdle(conn)
+	}
+}
+
+// Handler for text protocols delimited by \n or \r\n. fn is called once per
+// line, without the line terminator, until the peer closes the connection or fn
+// returns an error. line is reused for the next line, so copy it to keep it.
+// A line longer than maxLine bytes closes the connection.
+// maxLine must be greater than zero
+func LineHandler(maxLine int, fn func(conn tcpserver.Connection, line []byte) error) tcpserver.RequestHandlerFunc {
+	if maxLine <= 0 {
+		panic("server: maxLine must be greater than zero")
+	}
+	return func(conn tcpserver.Connection) {
+		reportError(conn, readLines(conn, maxLine, fn))
+	}
+}
+
+func readLines(conn tcpserver.Connection, maxLine int, fn func(conn tcpserver.Connection, line []byte) error) error {
+	maxLine, errTooLarge := messageLimit(conn, maxLine, ErrLineTooLong)
+	r, release := acquireReader(conn)
+	defer release()
+	var line []byte
+	for {
+		var err error
+		line, err = readLine(r, line[:0], maxLine, errTooLarge)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(conn, line); err != nil {
+			return err
+		}
+		markIdle(conn)
+	}
+}
+
+// Appends the next line to buf and returns it without its \n or \r\n.
+// A final line without terminator is returned as is, io.EOF follows.
+// A line over maxLine fails with tooLong
+func readLine(r *bufio.Reader, buf []byte, maxLine int, tooLong error) ([]byte, error) {
+	// room for the terminator
+	limit := maxLine + 2
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(buf)+len(chunk) > limit {
+			return nil, fmt.Errorf("%w: exceeds limit of %d bytes", tooLong, maxLine)
+		}
+		buf = append(buf, chunk...)
+		switch {
+		case err == nil:
+			buf = bytes.TrimSuffix(buf[:len(buf)-1], []byte("\r"))
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(buf) > 0:
+		case err == io.EOF:
+			return nil, io.EOF
+		default:
+			return nil, fmt.Errorf("read line: %w", err)
+		}
+		if len(buf) > maxLine {
+			return nil, fmt.Errorf("%w: exceeds limit of %d bytes", tooLong, maxLine)
+		}
+		return buf, nil
+	}
+}
+
+// Handler for JSON-over-TCP protocols: consecutive JSON values are decoded from
+// the stream and fn is called once per value until the peer closes the
+// connection or fn returns an error. Malformed JSON or a value larger than
+// WithMaxMessageSize closes the connection
+func JSONHandler[T any](fn func(conn tcpserver.Connection, msg T) error) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		reportError(conn, readJSON(conn, fn))
+	}
+}
+
+func readJSON[T any](conn tcpserver.Connection, fn func(conn tcpserver.Connection, msg T) error) error {
+	var dec *json.Decoder
+	var limit *messageReader
+	if max, _ := messageLimit(conn, math.MaxInt, nil); max < math.MaxInt {
+		limit = &messageReader{r: conn, max: int64(max)}
+		dec = json.NewDecoder(limit)
+	} else {
+		dec = json.NewDecoder(conn)
+	}
+	for {
+		if limit != nil {
+			limit.start(dec.InputOffset())
+		}
+		var msg T
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("decode json message: %w", err)
+		}
+		if err := fn(conn, msg); err != nil {
+			return err
+		}
+		markIdle(conn)
+	}
+}
+
+// Handler for netstring framed protocols (<length>:<data>,). fn is called once
+// per netstring until the peer closes the connection or fn returns an error.
+// A declared length over maxLen or malformed framing closes the connection.
+// maxLen must be greater than zero
+func NetstringHandler(maxLen int, fn func(conn tcpserver.Connection, data []byte) error) tcpserver.RequestHandlerFunc {
+	if maxLen <= 0 {
+		panic("server: maxLen must be greater than zero")
+	}
+	return func(conn tcpserver.Connection) {
+		reportError(conn, readNetstrings(conn, maxLen, fn))
+	}
+}
+
+func readNetstrings(conn tcpserver.Connection, maxLen int, fn func(conn tcpserver.Connection, data []byte) error) error {
+	maxLen, errTooLarge := messageLimit(conn, maxLen, ErrFrameTooLarge)
+	r, release := acquireReader(conn)
+	defer release()
+	for {
+		size, err := readNetstringLength(r, maxLen, errTooLarge)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			return nil
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("read netstring: %w", err)
+		}
+		if data[size] != ',' {
+			return fmt.Errorf("%w: missing trailing comma", ErrMalformedNetstring)
+		}
+		if err := fn(conn, data[:size]); err != nil {
+			return err
+		}
+		markIdle(conn)
+	}
+}
+
+// Reads the decimal length and its colon. Returns -1 when the stream ends cleanly
+// before a new netstring starts. A length over maxLen fails with tooLarge
+func readNetstringLength(r *bufio.Reader, maxLen int, tooLarge error) (int, error) {
+	size, digits := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && digits == 0 {
+				return -1, nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("read netstring length: %w", err)
+		}
+		switch {
+		case b >= '0' && b <= '9':
+			if digits == 1 && size == 0 {
+				return 0, fmt.Errorf("%w: leading zero in length", ErrMalformedNetstring)
+			}
+			size = size*10 + int(b-'0')
+			digits++
+			if size > maxLen {
+				return 0, fmt.Errorf("%w: netstring exceeds limit of %d bytes", tooLarge, maxLen)
+			}
+		case b == ':' && digits > 0:
+			return size, nil
+		default:
+			return 0, fmt.Errorf("%w: unexpected byte %q in length", ErrMalformedNetstring, b)
+		}
+	}
+}
+
+const (
+	defaultReadBufferSize  = 4096
+	defaultWriteBufferSize = 4096
+)
+
+// Readers for connections that don't carry the server's pool
+var defaultReaderPool = newReaderPool(defaultReadBufferSize)
+
+// Pool of *bufio.Reader of the given size
+func newReaderPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			return bufio.NewReaderSize(nil, size)
+		},
+	}
+}
+
+// Pool of *bufio.Writer of the given size
+func newWriterPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			return bufio.NewWriterSize(nil, size)
+		},
+	}
+}
+
+// Takes a buffered reader for c from the server's pool (see WithBufferPool).
+// release resets the reader and puts it back; call it when the handler is done
+func acquireReader(c tcpserver.Connection) (r *bufio.Reader, release func()) {
+	pool := defaultReaderPool
+	if wc, ok := c.(*conn); ok && wc.cfg.readers != nil {
+		pool = wc.cfg.readers
+	}
+	r, ok := pool.Get().(*bufio.Reader)
+	if !ok {
+		r = bufio.NewReaderSize(nil, defaultReadBufferSize)
+	}
+	r.Reset(c)
+	return r, func() {
+		r.Reset(nil)
+		pool.Put(r)
+	}
+}
+
+// Hands the error a framing helper stopped with to the WithErrorHandler callback
+func reportError(c tcpserver.Connection, err error) {
+	if err == nil {
+		return
+	}
+	wc, ok := c.(*conn)
+	if !ok {
+		return
+	}
+	wc.err = err
+	if wc.cfg.onError != nil {
+		wc.cfg.onError(wc, err)
+	}
+}
+
+// Limit a framing helper enforces: its own max, or WithMaxMessageSize if that is
+// lower, along with the error to report when a message exceeds it
+func messageLimit(c tcpserver.Connection, max int, tooLarge error) (int, error) {
+	if wc, ok := c.(*conn); ok && wc.cfg.maxMessageSize > 0 && wc.cfg.maxMessageSize < max {
+		return wc.cfg.maxMessageSize, ErrMessageTooLarge
+	}
+	return max, tooLarge
+}
+
+// Bounds how far a JSON decoder may read past the start of the current value.
+// The decoder only reads more when the value it decodes is incomplete, so hitting
+// the bound means the value itself is too large
+type messageReader struct {
+	r     io.Reader
+	max   int64
+	read  int64
+	limit int64
+}
+
+// Starts a new message at the given offset into the stream
+func (m *messageReader) start(offset int64) {
+	m.limit = offset + m.max
+}
+
+func (m *messageReader) Read(b []byte) (int, error) {
+	left := m.limit - m.read
+	if left <= 0 {
+		return 0, fmt.Errorf("%w: exceeds limit of %d bytes", ErrMessageTooLarge, m.max)
+	}
+	if int64(len(b)) > left {
+		b = b[:left]
+	}
+	n, err := m.r.Read(b)
+	m.read += int64(n)
+	return n, err
+}
+
+// Reports the connection idle between two messages, if it is tracked by WithConnState
+func markIdle(c tcpserver.Connection) {
+	if wc, ok := c.(*conn); ok {
+		wc.setState(StateIdle)
+	}
+}
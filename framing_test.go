@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Collects the messages a framing helper hands its callback
+type recorder struct {
+	msgs []string
+}
+
+func (c *recorder) add(conn tcpserver.Connection, msg []byte) error {
+	c.msgs = append(c.msgs, string(msg))
+	return nil
+}
+
+// Length prefix for a frame of n bytes
+func prefix(n int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(n))
+}
+
+func TestLengthPrefixedHandler(t *testing.T) {
+	var got recorder
+	h := LengthPrefixedHandler(8, got.add)
+	// frames split across reads
+	input := append(append(prefix(5), "hello"...), append(prefix(0), prefix(3)...)...)
+	_, _, err := RunHandlerInMemory(h, [][]byte{input[:3], input[3:7], append(input[7:], "abc"...)})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if want := []string{"hello", "", "abc"}; !slices.Equal(got.msgs, want) {
+		t.Fatalf("frames %q, want %q", got.msgs, want)
+	}
+
+	if _, _, err := RunHandlerInMemory(h, [][]byte{prefix(9)}); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized frame: error %v, want ErrFrameTooLarge", err)
+	}
+	if _, _, err := RunHandlerInMemory(h, [][]byte{prefix(5)[:2]}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated prefix: error %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestLineHandler(t *testing.T) {
+	var got recorder
+	h := LineHandler(8, got.add)
+	_, _, err := RunHandlerInMemory(h, [][]byte{[]byte("one\r\ntw"), []byte("o\n\nlast")})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if want := []string{"one", "two", "", "last"}; !slices.Equal(got.msgs, want) {
+		t.Fatalf("lines %q, want %q", got.msgs, want)
+	}
+
+	if _, _, err := RunHandlerInMemory(h, [][]byte{[]byte("overlong line\n")}); !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("overlong line: error %v, want ErrLineTooLong", err)
+	}
+	stop := errors.New("stop")
+	h = LineHandler(8, func(conn tcpserver.Connection, line []byte) error { return stop })
+	if _, _, err := RunHandlerInMemory(h, [][]byte{[]byte("a\nb\n")}); err != stop {
+		t.Errorf("callback error: error %v, want it returned as is", err)
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	type msg struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	var got []msg
+	h := JSONHandler(func(conn tcpserver.Connection, m msg) error {
+		got = append(got, m)
+		return nil
+	})
+	_, _, err := RunHandlerInMemory(h, [][]byte{[]byte(`{"id":1,"name":"a"}{"id":2,`), []byte(`"name":"b"}` + "\n")})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if want := []msg{{1, "a"}, {2, "b"}}; !slices.Equal(got, want) {
+		t.Fatalf("messages %+v, want %+v", got, want)
+	}
+
+	if _, _, err := RunHandlerInMemory(h, [][]byte{[]byte(`{"id":`), []byte("}")}); err == nil {
+		t.Error("malformed json accepted")
+	}
+}
+
+func TestNetstringHandler(t *testing.T) {
+	var got recorder
+	h := NetstringHandler(8, got.add)
+	_, _, err := RunHandlerInMemory(h, [][]byte{[]byte("5:hel"), []byte("lo,0:,"), []byte("3:abc,")})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	if want := []string{"hello", "", "abc"}; !slices.Equal(got.msgs, want) {
+		t.Fatalf("netstrings %q, want %q", got.msgs, want)
+	}
+
+	tests := []struct {
+		input string
+		want  error
+	}{
+		{"9:123456789,", ErrFrameTooLarge},
+		{"3:abc;", ErrMalformedNetstring},
+		{"03:abc,", ErrMalformedNetstring},
+		{"x:", ErrMalformedNetstring},
+		{"3:ab", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, _, err := RunHandlerInMemory(h, [][]byte{[]byte(tt.input)}); !errors.Is(err, tt.want) {
+			t.Errorf("%q: error %v, want %v", tt.input, err, tt.want)
+		}
+	}
+}
+
+// Runs h on an in-memory connection reading input, with readers from pool
+func serveInMemory(pool *sync.Pool, h tcpserver.RequestHandlerFunc, input []byte) {
+	cfg := &connConfig{stats: &counters{}, registry: newRegistry(), readers: pool}
+	cfg.serve(NewFakeConn(input), h)
+}
+
+func TestReadBufferSize(t *testing.T) {
+	if _, err := New(WithReadBufferSize(0)); err == nil {
+		t.Fatal("New accepted a read buffer size of 0")
+	}
+	s, err := New(WithReadBufferSize(64))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	r := s.cc.Load().readers.Get().(*bufio.Reader)
+	if r.Size() != 64 {
+		t.Fatalf("reader size %d, want 64", r.Size())
+	}
+}
+
+func BenchmarkLineHandler(b *testing.B) {
+	input := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1<<14)
+	h := LineHandler(1024, func(conn tcpserver.Connection, line []byte) error {
+		return nil
+	})
+	for _, size := range []int{512, 4096, 65536} {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			pool := newReaderPool(size)
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				serveInMemory(pool, h, input)
+			}
+		})
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	if _, err := New(WithBufferPool(nil)); err == nil {
+		t.Fatal("New accepted a nil buffer pool")
+	}
+	var created int
+	pool := &sync.Pool{New: func() any {
+		created++
+		return bufio.NewReaderSize(nil, 16)
+	}}
+	var lines []string
+	serveInMemory(pool, LineHandler(64, func(conn tcpserver.Connection, line []byte) error {
+		lines = append(lines, string(line))
+		return nil
+	}), []byte("a line longer than the buffer\nb\n"))
+	if created != 1 {
+		t.Fatalf("pool created %d readers, want 1", created)
+	}
+	if len(lines) != 2 || lines[0] != "a line longer than the buffer" || lines[1] != "b" {
+		t.Fatalf("lines %q", lines)
+	}
+}
+
+func BenchmarkReaderPool(b *testing.B) {
+	input := []byte("hello\n")
+	h := LineHandler(1024, func(conn tcpserver.Connection, line []byte) error {
+		return nil
+	})
+	b.Run("pooled", func(b *testing.B) {
+		pool := newReaderPool(defaultReadBufferSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			serveInMemory(pool, h, input)
+		}
+	})
+	b.Run("per connection", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			serveInMemory(newReaderPool(defaultReadBufferSize), h, input)
+		}
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	echo := func(conn tcpserver.Connection, line []byte) error {
+		_, err := conn.Write(append(line, '\n'))
+		return err
+	}
+	tests := []struct {
+		name    string
+		handler tcpserver.RequestHandlerFunc
+		input   string
+		want    string
+		err     error
+	}{
+		{"line", LineHandler(1024, echo), "ok\nlonger\n", "ok\n", ErrMessageTooLarge},
+		{"lower own limit", LineHandler(2, echo), "ok\nabc\n", "ok\n", ErrLineTooLong},
+		{"frame", LengthPrefixedHandler(1024, echo), string(prefix(5)) + "hello", "", ErrMessageTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			s := startServer(t, WithMaxMessageSize(4), WithRequestHandler(tt.handler),
+				WithErrorHandler(func(conn tcpserver.Connection, err error) { errs <- err }))
+			conn := dial(t, s.Addr())
+			conn.Write([]byte(tt.input))
+			if got := readAll(t, conn); got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+			if err := handlerError(t, errs); !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	// the decoder stops reading at the limit, so the close may reset the
+	// connection and only the error is checked
+	errs := make(chan error, 1)
+	s := startServer(t, WithMaxMessageSize(4),
+		WithRequestHandler(JSONHandler(func(conn tcpserver.Connection, v string) error { return nil })),
+		WithErrorHandler(func(conn tcpserver.Connection, err error) { errs <- err }))
+	dial(t, s.Addr()).Write([]byte(`"ab" "longer"`))
+	if err := handlerError(t, errs); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("json: error %v, want ErrMessageTooLarge", err)
+	}
+
+	if _, err := New(WithMaxMessageSize(0)); err == nil {
+		t.Error("New accepted a zero max message size")
+	}
+}
@@ -2,6 +2,10 @@ module github.com/quietpleasure/server-tcp
 
 go 1.23.0
 
-require github.com/maurice2k/tcpserver v1.2.0
+require (
+	github.com/maurice2k/tcpserver v1.2.0
+	golang.org/x/sys v0.22.0
+	golang.org/x/time v0.11.0
+)
 
 require github.com/maurice2k/ultrapool v1.1.1 // indirect
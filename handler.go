@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Decorates a request handler with cross-cutting behavior
+type Middleware func(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc
+
+// Composes mw around h, the first middleware being the outermost
+func chain(h tcpserver.RequestHandlerFunc, mw ...Middleware) tcpserver.RequestHandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Assembles the request handler. Listed from the outermost, a connection goes
+// through: the pause gate, accounting, socket options, panic recovery, server
+// context, PROXY header, IP filter, accept rate limit, per-IP limit, connect
+// hooks, concurrent handler limit, lifecycle callbacks, the handler timeout, the connection
+// wrapper, the health check, the user middleware, the protocol dispatcher and
+// finally the handler
+func (s *Server) buildHandler(opt *options) tcpserver.RequestHandlerFunc {
+	var handler tcpserver.RequestHandlerFunc = s.serveRequest
+	if opt.dispatcher != nil {
+		handler = opt.dispatcher.handler(handler)
+	}
+	handler = chain(handler, opt.middleware...)
+	if opt.healthCheckPath != "" {
+		handler = healthHandler(opt.healthCheckPath, handler)
+	}
+	handler = s.connHandler(handler)
+	if opt.handlerTimeout != nil {
+		handler = timeoutHandler(*opt.handlerTimeout, handler)
+	}
+	if len(opt.onConnect) > 0 || len(opt.onDisconnect) > 0 {
+		handler = lifecycleHandler(opt.onConnect, opt.onDisconnect, handler)
+	}
+	if opt.maxConcurrentHandlers != nil {
+		var wait time.Duration
+		if opt.handlerQueueTimeout != nil {
+			wait = *opt.handlerQueueTimeout
+		}
+		handler = newHandlerSlots(*opt.maxConcurrentHandlers, wait, s.done).handler(handler)
+	}
+	if len(opt.connectHooks) > 0 {
+		handler = connectHookHandler(s.log, opt.connectHooks, handler)
+	}
+	if opt.maxConnectionsPerIP != nil {
+		handler = newIPLimiter(*opt.maxConnectionsPerIP).handler(handler)
+	}
+	if opt.acceptRateLimit != nil {
+		handler = acceptRateHandler(opt.acceptRateLimit, handler)
+	}
+	if opt.ipFilter != nil {
+		handler = opt.ipFilter.handler(handler)
+	}
+	if opt.proxyProtocol {
+		timeout := proxyHeaderTimeout
+		if opt.firstByteTimeout != nil {
+			timeout = *opt.firstByteTimeout
+		} else if opt.readTimeout != nil {
+			timeout = *opt.readTimeout
+		}
+		handler = proxyHandler(s.log, timeout, handler)
+	}
+	if opt.ctx != nil {
+		handler = contextHandler(s.GetContext(), handler)
+	}
+	if opt.onPanic != nil || opt.logger != nil {
+		handler = recoverHandler(s.log, &s.stats.panics, opt.onPanic, handler)
+	}
+	if !opt.sockopts.empty() {
+		handler = opt.sockopts.handler(s.log, handler)
+	}
+	return s.gateHandler(s.trackHandler(handler))
+}
+
+// Returns the current request handler, nil if none was set
+func (s *Server) requestHandler() tcpserver.RequestHandlerFunc {
+	if h := s.handler.Load(); h != nil {
+		return *h
+	}
+	return nil
+}
+
+// Runs the current request handler. Without one the connection is just closed
+func (s *Server) serveRequest(conn tcpserver.Connection) {
+	if h := s.requestHandler(); h != nil {
+		h(conn)
+	}
+}
+
+// Wraps the connection according to the current connection config
+func (s *Server) connHandler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		s.cc.Load().serve(conn, next)
+	}
+}
+
+// Hands the server context to every connection before the handler runs
+func contextHandler(ctx *context.Context, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		conn.SetContext(ctx)
+		next(conn)
+	}
+}
+
+// Gives the handler a context that expires after d and closes the connection
+// at that point, whether or not it is busy with I/O
+func timeoutHandler(d time.Duration, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		ctx, cancel := context.WithTimeout(*conn.GetContext(), d)
+		defer cancel()
+		conn.SetContext(&ctx)
+		socket := socketOf(conn)
+		timer := time.AfterFunc(d, func() {
+			// the deadline passes first, so a handler failing on the closed
+			// connection finds its context expired rather than cancelled
+			<-ctx.Done()
+			socket.Close()
+		})
+		defer timer.Stop()
+		next(conn)
+	}
+}
+
+// Closes the connection without running next as soon as a hook rejects it
+func connectHookHandler(log *slog.Logger, hooks []func(conn tcpserver.Connection) error, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		for _, hook := range hooks {
+			if err := hook(conn); err != nil {
+				log.Debug("connection rejected", "client", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+		}
+		next(conn)
+	}
+}
+
+// Runs the connect callbacks before the handler and the disconnect callbacks
+// after it, the latter also when the handler panics
+func lifecycleHandler(onConnect, onDisconnect []func(conn tcpserver.Connection), next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		defer func() {
+			for _, f := range onDisconnect {
+				f(conn)
+			}
+		}()
+		for _, f := range onConnect {
+			f(conn)
+		}
+		next(conn)
+	}
+}
+
+// Logs handler panics. With onPanic set the panic is recovered, the connection
+// closed and onPanic called; otherwise the panic continues after being logged
+func recoverHandler(log *slog.Logger, panics *atomic.Int64, onPanic func(conn tcpserver.Connection, r any, stack []byte), next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			stack := debug.Stack()
+			panics.Add(1)
+			log.Error("handler panic", "client", conn.RemoteAddr().String(), "panic", r)
+			if onPanic == nil {
+				panic(r)
+			}
+			conn.Close()
+			onPanic(conn, r, stack)
+		}()
+		next(conn)
+	}
+}
+
+// Counts the connection as active for as long as the handler chain runs and
+// records how long that was. Shutdown waits for it over the same span
+func (s *Server) trackHandler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		s.stats.accepted.Add(1)
+		s.stats.active.Add(1)
+		s.conns.enter(conn)
+		start := time.Now()
+		defer func() {
+			s.stats.durations.observe(time.Since(start))
+			s.conns.leave(conn)
+			s.stats.active.Add(-1)
+		}()
+		next(conn)
+	}
+}
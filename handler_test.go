@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Waits up to a second for the next event
+func nextEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return ""
+	}
+}
+
+func TestOnConnectAndDisconnect(t *testing.T) {
+	events := make(chan string, 8)
+	record := func(e string) func(tcpserver.Connection) {
+		return func(tcpserver.Connection) { events <- e }
+	}
+	s := startServer(t,
+		WithOnConnect(record("connect 1")),
+		WithOnConnect(record("connect 2")),
+		WithOnDisconnect(record("disconnect")),
+		WithRecover(func(tcpserver.Connection, any, []byte) {}),
+		WithRequestHandler(func(conn tcpserver.Connection) {
+			events <- "handler"
+			panic("boom")
+		}),
+	)
+	dial(t, s.Addr())
+	for _, want := range []string{"connect 1", "connect 2", "handler", "disconnect"} {
+		if got := nextEvent(t, events); got != want {
+			t.Fatalf("event %q, want %q", got, want)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	type recovered struct {
+		value any
+		stack []byte
+	}
+	panics := make(chan recovered, 1)
+	s := startServer(t,
+		WithRecover(func(conn tcpserver.Connection, r any, stack []byte) {
+			panics <- recovered{r, stack}
+		}),
+		WithRequestHandler(func(conn tcpserver.Connection) {
+			panic("boom")
+		}),
+	)
+	conn := dial(t, s.Addr())
+	if got := readAll(t, conn); got != "" {
+		t.Fatalf("read %q from a panicking handler", got)
+	}
+	select {
+	case p := <-panics:
+		if p.value != "boom" || len(p.stack) == 0 {
+			t.Fatalf("recovered %v with a %d byte stack", p.value, len(p.stack))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("panic not recovered")
+	}
+	if n := s.Stats().HandlerPanics; n != 1 {
+		t.Fatalf("HandlerPanics = %d, want 1", n)
+	}
+	// the server keeps serving
+	dial(t, s.Addr())
+	select {
+	case <-panics:
+	case <-time.After(time.Second):
+		t.Fatal("handler didn't run after the panic")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tag := func(name string) Middleware {
+		return func(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+			return func(conn tcpserver.Connection) {
+				conn.Write([]byte(name + ">"))
+				next(conn)
+				conn.Write([]byte("<" + name))
+			}
+		}
+	}
+	s := startServer(t,
+		WithMiddleware(tag("a"), tag("b")),
+		WithMiddleware(tag("c")),
+		WithRequestHandler(reply("h")),
+	)
+	if got, want := readAll(t, dial(t, s.Addr())), "a>b>c>h<c<b<a"; got != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+	if _, err := New(WithMiddleware(nil)); err == nil {
+		t.Fatal("New accepted a nil middleware")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	type result struct{ ctx, read error }
+	results := make(chan result, 1)
+	s := startServer(t, WithHandlerTimeout(100*time.Millisecond), WithRequestHandler(func(conn tcpserver.Connection) {
+		_, err := conn.Read(make([]byte, 1))
+		results <- result{(*conn.GetContext()).Err(), err}
+	}))
+	dial(t, s.Addr())
+	begin := time.Now()
+	select {
+	case r := <-results:
+		if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+			t.Errorf("handler stopped after %v, before the timeout", elapsed)
+		}
+		if !errors.Is(r.ctx, context.DeadlineExceeded) {
+			t.Errorf("context error %v, want context.DeadlineExceeded", r.ctx)
+		}
+		if !errors.Is(r.read, net.ErrClosed) {
+			t.Errorf("read error %v, want net.ErrClosed", r.read)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler still running past its timeout")
+	}
+	if _, err := New(WithHandlerTimeout(0)); err == nil {
+		t.Error("New accepted a zero handler timeout")
+	}
+}
+
+func TestConnectHook(t *testing.T) {
+	var connects atomic.Int64
+	var n atomic.Int64
+	s := startServer(t,
+		WithConnectHook(func(conn tcpserver.Connection) error {
+			_, err := conn.Write([]byte("checked "))
+			return err
+		}),
+		WithConnectHook(func(conn tcpserver.Connection) error {
+			if n.Add(1)%2 == 0 {
+				return errors.New("rejected")
+			}
+			return nil
+		}),
+		WithOnConnect(func(conn tcpserver.Connection) { connects.Add(1) }),
+		WithRequestHandler(reply("hello")),
+	)
+	for i, want := range []string{"checked hello", "checked ", "checked hello"} {
+		if got := readAll(t, dial(t, s.Addr())); got != want {
+			t.Errorf("connection %d read %q, want %q", i, got, want)
+		}
+	}
+	if got := connects.Load(); got != 2 {
+		t.Errorf("OnConnect ran %d times, want only for the 2 admitted connections", got)
+	}
+	if _, err := New(WithConnectHook(nil)); err == nil {
+		t.Error("New accepted a nil connect hook")
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+const healthResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 3\r\nConnection: close\r\n\r\nOK\n"
+
+// Upper bound on the health check request head
+const maxHealthRequest = 8192
+
+// How long a connection has to start its request before it is passed on as no
+// health probe. Clients of server-first protocols wait for the handler to speak
+const healthCheckWait = 200 * time.Millisecond
+
+// Answers HTTP GET requests for path with 200 OK and passes every other
+// connection on to next with its stream intact
+func healthHandler(path string, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	prefix := []byte("GET " + path + " ")
+	return func(c tcpserver.Connection) {
+		wc, ok := c.(*conn)
+		if !ok {
+			next(c)
+			return
+		}
+		// the wait is for the request, not for the TLS handshake before it
+		if tc, ok := tlsConn(wc); ok {
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+		}
+		match, err := wc.peekPrefix(prefix, healthCheckWait)
+		if err != nil {
+			return
+		}
+		if !match {
+			next(c)
+			return
+		}
+		// consume the request head, closing with unread input would reset the
+		// connection before the client reads the reply
+		for read := 0; read < maxHealthRequest; {
+			line, err := ReadUntil(wc, '\n', maxHealthRequest-read)
+			if err != nil {
+				return
+			}
+			read += len(line)
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				wc.Write([]byte(healthResponse))
+				return
+			}
+		}
+	}
+}
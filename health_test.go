@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handler echoing everything the client sends until it closes its side
+func echo(conn tcpserver.Connection) {
+	b, _ := io.ReadAll(conn)
+	conn.Write(b)
+}
+
+func TestHealthCheck(t *testing.T) {
+	s := startServer(t, WithHealthCheck("/healthz"), WithRequestHandler(echo))
+	resp, err := http.Get("http://" + s.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "OK\n" {
+		t.Errorf("GET /healthz = %d %q, want 200 %q", resp.StatusCode, body, "OK\n")
+	}
+
+	for _, input := range []string{"GET /other HTTP/1.1\r\n\r\n", "G", "hello"} {
+		conn := dial(t, s.Addr())
+		conn.Write([]byte(input))
+		closeWrite(conn)
+		if got := readAll(t, conn); got != input {
+			t.Errorf("handler got %q, want %q", got, input)
+		}
+	}
+
+	for _, path := range []string{"healthz", "/health z"} {
+		if _, err := New(WithHealthCheck(path)); err == nil {
+			t.Errorf("New accepted health check path %q", path)
+		}
+	}
+}
+
+func TestHealthCheckServerFirst(t *testing.T) {
+	s := startServer(t, WithHealthCheck("/healthz"), WithRequestHandler(func(conn tcpserver.Connection) {
+		conn.Write([]byte("220 ready\r\n"))
+		echo(conn)
+	}))
+	conn := dial(t, s.Addr())
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+	if banner, err := r.ReadString('\n'); err != nil || banner != "220 ready\r\n" {
+		t.Fatalf("read banner %q, %v", banner, err)
+	}
+	conn.Write([]byte("HELO"))
+	closeWrite(conn)
+	if rest, err := io.ReadAll(r); err != nil || string(rest) != "HELO" {
+		t.Errorf("read %q, %v after the banner, want HELO", rest, err)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Returned by ReadUntil when the delimiter doesn't show up within the limit
+var ErrDelimiterNotFound = errors.New("delimiter not found")
+
+// Reads up to and including delim. The connection is read a byte at a time, so
+// nothing past the delimiter is consumed and the caller can go on reading from
+// conn directly. ErrDelimiterNotFound is returned with the data read so far when
+// max bytes pass without delim, io.ErrUnexpectedEOF when the peer closes midway
+// and io.EOF when it closes before sending anything. max must be greater than
+// zero, nothing is read otherwise
+func ReadUntil(conn tcpserver.Connection, delim byte, max int) ([]byte, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("max must be greater than zero, got %d", max)
+	}
+	var b [1]byte
+	buf := make([]byte, 0, min(max, 64))
+	for len(buf) < max {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return buf, err
+		}
+		buf = append(buf, b[0])
+		if b[0] == delim {
+			return buf, nil
+		}
+	}
+	return buf, fmt.Errorf("%w within %d bytes", ErrDelimiterNotFound, max)
+}
+
+// Reads exactly n bytes. io.ErrUnexpectedEOF is returned with the data read so
+// far when the peer closes midway, io.EOF when it closes before sending anything.
+// n cannot be negative, nothing is read otherwise
+func ReadExactly(conn tcpserver.Connection, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("n cannot be negative, got %d", n)
+	}
+	buf := make([]byte, n)
+	read, err := io.ReadFull(conn, buf)
+	return buf[:read], err
+}
+
+// Writes msg and closes the connection, for goodbye or rejection lines.
+// writeTimeout bounds the write and replaces any WithWriteTimeout for it,
+// zero means no deadline. The connection is closed even if the write fails,
+// the write error is returned
+func CloseWithMessage(conn tcpserver.Connection, msg []byte, writeTimeout time.Duration) error {
+	err := writeWithTimeout(conn, msg, writeTimeout)
+	conn.Close()
+	return err
+}
+
+func writeWithTimeout(c tcpserver.Connection, b []byte, timeout time.Duration) error {
+	if wc, ok := c.(*conn); ok {
+		_, err := wc.writeDirect(b, timeout)
+		return err
+	}
+	if timeout > 0 {
+		if err := c.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	_, err := c.Write(b)
+	return err
+}
+
+// Shuts down the writing side of the connection, sending the peer a FIN while
+// the handler can go on reading, for protocols where the server signals the end
+// of its response that way. Writes buffered under WithWriteBufferSize are sent
+// first and, on TLS connections, a close_notify alert. The reverse, a peer
+// half-closing its side to end the request, shows up in the handler as io.EOF
+// from Read while writes still succeed. Fails with errors.ErrUnsupported when
+// conn is not backed by a TCP socket
+func CloseWrite(conn tcpserver.Connection) error {
+	return closeWrite(conn)
+}
+
+func closeWrite(c net.Conn) error {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v.CloseWrite()
+		case *conn:
+			if err := v.flush(); err != nil {
+				return err
+			}
+		case *tls.Conn:
+			if err := v.CloseWrite(); err != nil {
+				return err
+			}
+		}
+		inner, ok := innerConn(c)
+		if !ok {
+			return fmt.Errorf("close write: %w", errors.ErrUnsupported)
+		}
+		c = inner
+	}
+}
+
+// Sends the writes buffered under WithWriteBufferSize, for handlers about to
+// wait on something other than a read from conn, or to learn whether the
+// writes went through. Reading from conn flushes by itself, and so does the
+// handler returning. Does nothing when writes aren't buffered. Fails with
+// errors.ErrUnsupported when conn is wrapped in a type of the handler's own, as
+// middleware may do; flush the connection it wraps instead
+func Flush(conn tcpserver.Connection) error {
+	return flush(conn)
+}
+
+func flush(c net.Conn) error {
+	for {
+		switch v := c.(type) {
+		case *conn:
+			return v.flush()
+		case *net.TCPConn, *FakeConn:
+			return nil
+		}
+		inner, ok := innerConn(c)
+		if !ok {
+			return fmt.Errorf("flush: %w", errors.ErrUnsupported)
+		}
+		c = inner
+	}
+}
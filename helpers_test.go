@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestCloseWithMessage(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithWriteBufferSize(64), WithWriteTimeout(time.Second)}} {
+		errs := make(chan error, 1)
+		s := startServer(t, append(opts, WithRequestHandler(func(conn tcpserver.Connection) {
+			conn.Write([]byte("[buffered] "))
+			errs <- CloseWithMessage(conn, []byte("bye\n"), time.Second)
+		}))...)
+		if got, want := readAll(t, dial(t, s.Addr())), "[buffered] bye\n"; got != want {
+			t.Errorf("read %q, want %q", got, want)
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("CloseWithMessage: %v", err)
+		}
+	}
+}
+
+func TestReadUntil(t *testing.T) {
+	conn := NewFakeConn([]byte("HELO a"), []byte("\nrest"))
+	line, err := ReadUntil(conn, '\n', 16)
+	if err != nil || string(line) != "HELO a\n" {
+		t.Fatalf("ReadUntil = %q, %v", line, err)
+	}
+	rest, err := io.ReadAll(conn)
+	if err != nil || string(rest) != "rest" {
+		t.Errorf("read past the delimiter %q, %v, want %q", rest, err, "rest")
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		want  string
+		err   error
+	}{
+		{"limit", "abcdef\n", 4, "abcd", ErrDelimiterNotFound},
+		{"closed midway", "abc", 16, "abc", io.ErrUnexpectedEOF},
+		{"closed", "", 16, "", io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadUntil(NewFakeConn([]byte(tt.input)), '\n', tt.max)
+			if string(got) != tt.want || !errors.Is(err, tt.err) {
+				t.Errorf("ReadUntil = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+	for _, max := range []int{0, -1} {
+		conn := NewFakeConn([]byte("abc\n"))
+		if _, err := ReadUntil(conn, '\n', max); err == nil {
+			t.Errorf("ReadUntil accepted max %d", max)
+		}
+		if rest, _ := io.ReadAll(conn); string(rest) != "abc\n" {
+			t.Errorf("ReadUntil with max %d consumed input, %q left", max, rest)
+		}
+	}
+}
+
+func TestReadExactly(t *testing.T) {
+	conn := NewFakeConn([]byte("ab"), []byte("cdef"))
+	got, err := ReadExactly(conn, 4)
+	if err != nil || string(got) != "abcd" {
+		t.Fatalf("ReadExactly = %q, %v", got, err)
+	}
+	got, err = ReadExactly(conn, 4)
+	if string(got) != "ef" || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ReadExactly = %q, %v, want %q, %v", got, err, "ef", io.ErrUnexpectedEOF)
+	}
+	if got, err := ReadExactly(conn, 1); len(got) != 0 || err != io.EOF {
+		t.Errorf("ReadExactly after close = %q, %v, want io.EOF", got, err)
+	}
+	if _, err := ReadExactly(NewFakeConn([]byte("abc")), -1); err == nil {
+		t.Error("ReadExactly accepted a negative length")
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	cert := testCert(t, "127.0.0.1")
+	tests := []struct {
+		name string
+		opts []Option
+		dial func(t *testing.T, s *Server) net.Conn
+	}{
+		{"tcp", nil, func(t *testing.T, s *Server) net.Conn { return dial(t, s.Addr()) }},
+		{"buffered", []Option{WithWriteBufferSize(64)}, func(t *testing.T, s *Server) net.Conn { return dial(t, s.Addr()) }},
+		{"tls", []Option{WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})}, func(t *testing.T, s *Server) net.Conn {
+			conn, err := dialTLS(t, s.Addr(), &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1"})
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			return conn
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acks := make(chan string, 1)
+			s := startServer(t, append(tt.opts, WithRequestHandler(func(conn tcpserver.Connection) {
+				conn.Write([]byte("response"))
+				if err := CloseWrite(conn); err != nil {
+					acks <- err.Error()
+					return
+				}
+				ack, _ := ReadExactly(conn, 3)
+				acks <- string(ack)
+			}))...)
+			conn := tt.dial(t, s)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if b, err := io.ReadAll(conn); err != nil || string(b) != "response" {
+				t.Fatalf("read %q, %v before the server's FIN", b, err)
+			}
+			conn.Write([]byte("ack"))
+			select {
+			case ack := <-acks:
+				if ack != "ack" {
+					t.Errorf("server read %q after CloseWrite, want ack", ack)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("server still reading")
+			}
+		})
+	}
+
+	if err := CloseWrite(NewFakeConn()); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("CloseWrite on a FakeConn: %v, want errors.ErrUnsupported", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	errs := make(chan error, 1)
+	s := startServer(t, WithWriteBufferSize(64), WithRequestHandler(func(conn tcpserver.Connection) {
+		conn.Write([]byte("partial\n"))
+		errs <- Flush(conn)
+		<-release
+	}))
+	conn := dial(t, s.Addr())
+	if err := handlerError(t, errs); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	// the handler is still waiting, only the flush can have sent the write
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "partial\n" {
+		t.Errorf("read %q, %v, want the buffered write", b, err)
+	}
+	if err := Flush(NewFakeConn()); err != nil {
+		t.Errorf("Flush without buffering: %v", err)
+	}
+	if err := Flush(&proxyConn{Connection: NewFakeConn()}); err != nil {
+		t.Errorf("Flush through a server wrapper: %v", err)
+	}
+	type wrapped struct{ tcpserver.Connection }
+	if err := Flush(wrapped{NewFakeConn()}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Flush of a middleware wrapper = %v, want errors.ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"golang.org/x/time/rate"
+)
+
+// Active connection counts keyed by remote IP
+type ipLimiter struct {
+	max    int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newIPLimiter(max int) *ipLimiter {
+	return &ipLimiter{max: max, active: make(map[string]int)}
+}
+
+// Closes connections from IPs that already have max active connections
+func (l *ipLimiter) handler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		ip := conn.GetClientAddr().IP.String()
+		if !l.acquire(ip) {
+			conn.Close()
+			return
+		}
+		defer l.release(ip)
+		next(conn)
+	}
+}
+
+func (l *ipLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] <= 1 {
+		delete(l.active, ip)
+		return
+	}
+	l.active[ip]--
+}
+
+// Semaphore bounding how many handlers run at once
+type handlerSlots struct {
+	slots chan struct{}
+	// how long a connection waits for a slot, 0 for as long as it takes
+	wait time.Duration
+	// closed once the server has stopped; connections still waiting give up then
+	stopped <-chan struct{}
+}
+
+func newHandlerSlots(n int, wait time.Duration, stopped <-chan struct{}) *handlerSlots {
+	return &handlerSlots{slots: make(chan struct{}, n), wait: wait, stopped: stopped}
+}
+
+// Holds the connection until a slot is free, closing it if none frees up in
+// time or the server stops first
+func (h *handlerSlots) handler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		if !h.acquire() {
+			conn.Close()
+			return
+		}
+		defer func() { <-h.slots }()
+		next(conn)
+	}
+}
+
+func (h *handlerSlots) acquire() bool {
+	select {
+	case h.slots <- struct{}{}:
+		return true
+	default:
+	}
+	var expired <-chan time.Time
+	if h.wait > 0 {
+		timer := time.NewTimer(h.wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case h.slots <- struct{}{}:
+	case <-expired:
+		return false
+	case <-h.stopped:
+		return false
+	}
+	// a slot and the stop may be ready together
+	select {
+	case <-h.stopped:
+		<-h.slots
+		return false
+	default:
+		return true
+	}
+}
+
+// Closes connections that arrive faster than the limiter admits them
+func acceptRateHandler(limiter *rate.Limiter, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		if !limiter.Allow() {
+			conn.Close()
+			return
+		}
+		next(conn)
+	}
+}
+
+// Remote IP rules, deny taking precedence over allow
+type ipFilter struct {
+	allow []net.IPNet
+	deny  []net.IPNet
+}
+
+// An empty allow list allows every IP that isn't denied
+func (f *ipFilter) permits(ip net.IP) bool {
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes connections whose remote IP isn't permitted
+func (f *ipFilter) handler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		if !f.permits(conn.GetClientAddr().IP) {
+			conn.Close()
+			return
+		}
+		next(conn)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	handler := blocker(started, release)
+	s := startServer(t, WithMaxConnectionsPerIP(1), WithRequestHandler(func(conn tcpserver.Connection) {
+		handler(conn)
+		conn.Write([]byte("done"))
+	}))
+	first := dial(t, s.Addr())
+	<-started
+	if got := readAll(t, dial(t, s.Addr())); got != "" {
+		t.Fatalf("connection over the limit read %q", got)
+	}
+	close(release)
+	if got := readAll(t, first); got != "done" {
+		t.Fatalf("first connection read %q, want done", got)
+	}
+	if got := readAll(t, dial(t, s.Addr())); got != "done" {
+		t.Fatalf("connection after the release read %q, want done", got)
+	}
+}
+
+func TestAcceptRateLimit(t *testing.T) {
+	if _, err := New(WithAcceptRateLimit(0, 1)); err == nil {
+		t.Fatal("New accepted a rate of 0")
+	}
+	s := startServer(t, WithAcceptRateLimit(1, 2), WithRequestHandler(reply("hello")))
+	var served int
+	for i := 0; i < 4; i++ {
+		if readAll(t, dial(t, s.Addr())) == "hello" {
+			served++
+		}
+	}
+	// the burst gets through, the rest is closed until a token refills a second later
+	if served != 2 {
+		t.Fatalf("served %d of 4 connections, want the burst of 2", served)
+	}
+}
+
+// Parses CIDR blocks for IP filters
+func cidrs(t *testing.T, blocks ...string) []net.IPNet {
+	t.Helper()
+	nets := make([]net.IPNet, 0, len(blocks))
+	for _, b := range blocks {
+		_, n, err := net.ParseCIDR(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func TestIPFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		served      bool
+	}{
+		{"no rules", nil, nil, true},
+		{"allowed", []string{"127.0.0.0/8"}, nil, true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, false},
+		{"denied", nil, []string{"127.0.0.1/32"}, false},
+		{"deny wins", []string{"127.0.0.0/8"}, []string{"127.0.0.1/32"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, WithIPFilter(cidrs(t, tt.allow...), cidrs(t, tt.deny...)), WithRequestHandler(reply("hello")))
+			if served := readAll(t, dial(t, s.Addr())) == "hello"; served != tt.served {
+				t.Fatalf("served = %v, want %v", served, tt.served)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	s := startServer(t, WithMaxConcurrentHandlers(1), WithRequestHandler(blocker(started, release)))
+	dial(t, s.Addr())
+	<-started
+	dial(t, s.Addr())
+	select {
+	case <-started:
+		t.Fatal("second handler started while the first was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("queued handler didn't start once the first returned")
+	}
+}
+
+func TestStopWaitsForQueuedHandler(t *testing.T) {
+	var done <-chan struct{}
+	finished := make(chan bool, 2)
+	s, err := New(WithMaxConcurrentHandlers(1), WithRequestHandler(func(conn tcpserver.Connection) {
+		time.Sleep(150 * time.Millisecond)
+		select {
+		case <-done:
+			finished <- false
+		default:
+			finished <- true
+		}
+	}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// set before Start, so handlers see it without synchronizing
+	done = s.Done()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	dial(t, s.Addr())
+	dial(t, s.Addr())
+	deadline := time.Now().Add(time.Second)
+	for s.ActiveConnections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ActiveConnections() = %d, want 2", s.ActiveConnections())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Stop(0); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for range 2 {
+		select {
+		case ok := <-finished:
+			if !ok {
+				t.Error("handler ran after Done was closed")
+			}
+		default:
+			t.Fatal("Stop(0) returned before the queued handler ran")
+		}
+	}
+}
+
+func TestQueuedHandlerGivesUpOnStop(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	s := startServer(t, WithMaxConcurrentHandlers(1), WithRequestHandler(blocker(started, release)))
+	dial(t, s.Addr())
+	<-started
+	queued := dial(t, s.Addr())
+	deadline := time.Now().Add(time.Second)
+	for s.ActiveConnections() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ActiveConnections() = %d, want 2", s.ActiveConnections())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop(100 * time.Millisecond)
+	if got := readAll(t, queued); got != "" {
+		t.Errorf("queued connection read %q", got)
+	}
+	close(release)
+	select {
+	case <-started:
+		t.Error("queued handler started after the server stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandlerQueueTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	s := startServer(t, WithMaxConcurrentHandlers(1), WithHandlerQueueTimeout(100*time.Millisecond),
+		WithRequestHandler(blocker(started, release)))
+	dial(t, s.Addr())
+	<-started
+	begin := time.Now()
+	if got := readAll(t, dial(t, s.Addr())); got != "" {
+		t.Errorf("queued connection read %q", got)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Errorf("queued connection closed after %v, before the queue timeout", elapsed)
+	}
+	for _, opt := range []Option{WithMaxConcurrentHandlers(0), WithHandlerQueueTimeout(0)} {
+		if _, err := New(opt); err == nil {
+			t.Error("New accepted a zero limit")
+		}
+	}
+}
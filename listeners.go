@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Creates a server accepting on addr that shares the main server's handler
+// and settings
+func (s *Server) newExtraListener(addr string, opt *options) (*tcpserver.Server, error) {
+	srv, err := tcpserver.NewServer(addr)
+	if err != nil {
+		return nil, fmt.Errorf("creates a listener for %s: %w", addr, err)
+	}
+	lc := *s.GetListenConfig()
+	srv.SetListenConfig(&lc)
+	srv.SetLoops(s.GetLoops())
+	srv.SetWorkerpoolShards(s.GetWorkerpoolShards())
+	if opt.allowThreadLocking != nil {
+		srv.SetAllowThreadLocking(*opt.allowThreadLocking)
+	}
+	// the main server's ballast covers the process
+	srv.SetBallast(0)
+	if opt.ctx != nil {
+		srv.SetContext(s.GetContext())
+	}
+	srv.SetRequestHandler(s.chain)
+	return srv, nil
+}
+
+// Binds the additional listeners, closing the ones already bound on failure
+func (s *Server) listenExtra() error {
+	for i, srv := range s.extra {
+		// picks up TLS enabled by SetTLSConfig after New
+		srv.SetTLSConfig(s.GetTLSConfig())
+		listen := srv.Listen
+		if srv.GetTLSConfig() != nil {
+			listen = srv.ListenTLS
+		}
+		if err := s.bind(listen); err != nil {
+			for _, bound := range s.extra[:i] {
+				bound.Shutdown(0)
+			}
+			return fmt.Errorf("error listening on additional interface: %w", err)
+		}
+		s.log.Info("listening", "addr", srv.GetListenAddr().String(), "tls", srv.GetTLSConfig() != nil)
+	}
+	return nil
+}
+
+// Serves the additional listeners in the background until they are shut down.
+// A failing accept loop is reported but leaves the other listeners serving
+func (s *Server) serveExtra(wg *sync.WaitGroup) {
+	for _, srv := range s.extra {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Serve(); err != nil {
+				s.acceptFailed(srv.GetListenAddr(), err)
+			}
+		}()
+	}
+}
+
+// Shuts the additional listeners down, returning the first error but
+// shutting down the others anyway
+func (s *Server) shutdownExtra(d time.Duration) error {
+	var first error
+	for _, srv := range s.extra {
+		if err := srv.Shutdown(d); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Returns the addresses the server is bound to, the main one first followed by
+// those of WithAdditionalListener. Empty until the server is started
+func (s *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	if addr := s.Addr(); addr != nil {
+		addrs = append(addrs, addr)
+	}
+	for _, srv := range s.extra {
+		if addr := srv.GetListenAddr(); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
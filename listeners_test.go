@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdditionalListener(t *testing.T) {
+	s := startServer(t, WithAdditionalListener("127.0.0.1:0"), WithRequestHandler(reply("ok")))
+	addrs := s.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Addrs() = %v, want 2 addresses", addrs)
+	}
+	for _, addr := range addrs {
+		if got := readAll(t, dial(t, addr)); got != "ok" {
+			t.Errorf("%s: got %q, want %q", addr, got, "ok")
+		}
+	}
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr.String()); err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts after Stop", addr)
+		}
+	}
+}
+
+func TestAdditionalListenerInvalidAddress(t *testing.T) {
+	if _, err := New(WithAdditionalListener("no-port")); err == nil {
+		t.Fatal("New accepted an address without port")
+	}
+}
+
+func TestAdditionalListenersStopWithMain(t *testing.T) {
+	var hooks atomic.Int32
+	s := startServer(t,
+		WithMaxAcceptConnections(1),
+		WithAdditionalListener("127.0.0.1:0"),
+		WithOnShutdown(func() { hooks.Add(1) }),
+		WithRequestHandler(reply("ok")),
+	)
+	extra := s.Addrs()[1]
+	readAll(t, dial(t, s.Addr()))
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("Done not closed after the accept limit stopped the main listener")
+	}
+	if n := hooks.Load(); n != 1 {
+		t.Errorf("on shutdown hook ran %d times, want 1", n)
+	}
+	if conn, err := net.Dial("tcp", extra.String()); err == nil {
+		conn.Close()
+		t.Error("additional listener still accepts")
+	}
+}
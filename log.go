@@ -0,0 +1,17 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger used when none is configured
+var discardLogger = slog.New(discardHandler{})
+
+// slog.Handler that drops every record
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Buffer the server may log into from several goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Logger writing text records to the returned buffer
+func testLogger() (*slog.Logger, *logBuffer) {
+	buf := &logBuffer{}
+	return slog.New(slog.NewTextHandler(buf, nil)), buf
+}
+
+func TestLogger(t *testing.T) {
+	logger, logs := testLogger()
+	s := startServer(t,
+		WithLogger(logger),
+		WithRecover(func(tcpserver.Connection, any, []byte) {}),
+		WithRequestHandler(func(conn tcpserver.Connection) {
+			panic("boom")
+		}),
+	)
+	readAll(t, dial(t, s.Addr()))
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for _, msg := range []string{"msg=listening", `msg="handler panic"`, `msg="shutting down"`, "msg=stopped"} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("no %s record in\n%s", msg, logs)
+		}
+	}
+	if _, err := New(WithLogger(nil)); err == nil {
+		t.Fatal("New accepted a nil logger")
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Runs h against a FakeConn, without sockets or a server, and returns what
+// crossed it. The handler reads clientWrites in order, each Read returning
+// bytes of a single chunk, and then io.EOF. serverReads holds the data
+// each read took from the connection, which for handlers reading through a
+// buffer may span several Read calls of their own, and serverWrites the data of
+// each Write. err is the error a framing helper stopped with or, should h panic,
+// the panic. Server options don't apply, so neither do their timeouts and limits
+func RunHandlerInMemory(h tcpserver.RequestHandlerFunc, clientWrites [][]byte) (serverReads, serverWrites [][]byte, err error) {
+	fc := NewFakeConn(clientWrites...)
+	cfg := &connConfig{stats: &counters{}, registry: newRegistry()}
+	var wc *conn
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("handler panic: %v", r)
+			}
+		}()
+		cfg.serve(fc, func(c tcpserver.Connection) {
+			wc = c.(*conn)
+			h(c)
+		})
+	}()
+	if err == nil && wc != nil {
+		err = wc.err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.reads, fc.writes, err
+}
+
+// Connection for calling handlers directly in tests. Reads are served from
+// canned chunks and writes are recorded; nothing blocks, so deadlines have no
+// effect. Reads, writes and Close may be called concurrently
+type FakeConn struct {
+	// Reported as the peer and local addresses, 127.0.0.1:49152 and
+	// 127.0.0.1:8080 when nil. Set them before the handler runs
+	ClientAddr *net.TCPAddr
+	ServerAddr *net.TCPAddr
+
+	mu      sync.Mutex
+	pending [][]byte
+	reads   [][]byte
+	writes  [][]byte
+	closed  bool
+	ctx     *context.Context
+	server  *tcpserver.Server
+	start   time.Time
+}
+
+// Returns a connection whose reads return the bytes of chunks in order, each
+// Read serving a single chunk at most, and then io.EOF
+func NewFakeConn(chunks ...[]byte) *FakeConn {
+	pending := make([][]byte, 0, len(chunks))
+	for _, chunk := range chunks {
+		if len(chunk) > 0 {
+			pending = append(pending, append([]byte(nil), chunk...))
+		}
+	}
+	return &FakeConn{pending: pending, start: time.Now()}
+}
+
+func (c *FakeConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if len(c.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.pending[0])
+	if n == len(c.pending[0]) {
+		c.pending = c.pending[1:]
+	} else {
+		c.pending[0] = c.pending[0][n:]
+	}
+	c.reads = append(c.reads, append([]byte(nil), b[:n]...))
+	return n, nil
+}
+
+func (c *FakeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *FakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Returns everything written so far
+func (c *FakeConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var b []byte
+	for _, w := range c.writes {
+		b = append(b, w...)
+	}
+	return b
+}
+
+// Reports whether the connection was closed
+func (c *FakeConn) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+var (
+	fakeClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 49152}
+	fakeServerAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+)
+
+func (c *FakeConn) GetClientAddr() *net.TCPAddr {
+	if c.ClientAddr != nil {
+		return c.ClientAddr
+	}
+	return fakeClientAddr
+}
+
+func (c *FakeConn) GetServerAddr() *net.TCPAddr {
+	if c.ServerAddr != nil {
+		return c.ServerAddr
+	}
+	return fakeServerAddr
+}
+
+func (c *FakeConn) LocalAddr() net.Addr  { return c.GetServerAddr() }
+func (c *FakeConn) RemoteAddr() net.Addr { return c.GetClientAddr() }
+
+func (c *FakeConn) SetDeadline(time.Time) error      { return nil }
+func (c *FakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *FakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *FakeConn) SetServer(s *tcpserver.Server)   { c.server = s }
+func (c *FakeConn) GetServer() *tcpserver.Server    { return c.server }
+func (c *FakeConn) Reset(net.Conn)                  {}
+func (c *FakeConn) GetStartTime() time.Time         { return c.start }
+func (c *FakeConn) SetContext(ctx *context.Context) { c.ctx = ctx }
+func (c *FakeConn) Start()                          { c.start = time.Now() }
+
+func (c *FakeConn) GetContext() *context.Context {
+	if c.ctx == nil {
+		ctx := context.Background()
+		c.ctx = &ctx
+	}
+	return c.ctx
+}
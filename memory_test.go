@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Joins chunks into strings for comparison
+func chunks(b [][]byte) []string {
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = string(c)
+	}
+	return s
+}
+
+func TestRunHandlerInMemory(t *testing.T) {
+	upper := func(conn tcpserver.Connection) {
+		b := make([]byte, 8)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			conn.Write(bytes.ToUpper(b[:n]))
+		}
+	}
+	reads, writes, err := RunHandlerInMemory(upper, [][]byte{[]byte("hello"), []byte("wide world")})
+	if err != nil {
+		t.Fatalf("RunHandlerInMemory: %v", err)
+	}
+	want := []string{"hello", "wide wor", "ld"}
+	if !slices.Equal(chunks(reads), want) {
+		t.Errorf("server reads %q, want %q", chunks(reads), want)
+	}
+	if want := []string{"HELLO", "WIDE WOR", "LD"}; !slices.Equal(chunks(writes), want) {
+		t.Errorf("server writes %q, want %q", chunks(writes), want)
+	}
+
+	_, _, err = RunHandlerInMemory(func(conn tcpserver.Connection) { panic("boom") }, nil)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("panicking handler: error %v, want the panic", err)
+	}
+	_, _, err = RunHandlerInMemory(LineHandler(4, func(conn tcpserver.Connection, line []byte) error { return nil }),
+		[][]byte{[]byte("too long\n")})
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("framing helper: error %v, want ErrLineTooLong", err)
+	}
+}
+
+func TestFakeConn(t *testing.T) {
+	conn := NewFakeConn([]byte("ab"), nil, []byte("c"))
+	var _ tcpserver.Connection = conn
+	b := make([]byte, 8)
+	for _, want := range []string{"ab", "c"} {
+		if n, err := conn.Read(b); err != nil || string(b[:n]) != want {
+			t.Fatalf("Read = %q, %v, want %q", b[:n], err, want)
+		}
+	}
+	if _, err := conn.Read(b); err != io.EOF {
+		t.Fatalf("Read past the chunks: %v, want io.EOF", err)
+	}
+
+	conn.Write([]byte("x"))
+	conn.Write([]byte("yz"))
+	if got := string(conn.Written()); got != "xyz" {
+		t.Errorf("Written() = %q, want xyz", got)
+	}
+	if conn.RemoteAddr().String() != "127.0.0.1:49152" || conn.LocalAddr().String() != "127.0.0.1:8080" {
+		t.Errorf("addresses %v -> %v, want the defaults", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	conn.ClientAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	if conn.RemoteAddr().String() != "10.0.0.1:1" {
+		t.Errorf("RemoteAddr() = %v, want the configured address", conn.RemoteAddr())
+	}
+	if (*conn.GetContext()).Err() != nil {
+		t.Error("default context is done")
+	}
+
+	conn.Close()
+	if !conn.Closed() {
+		t.Error("Closed() = false after Close")
+	}
+	if _, err := conn.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after Close: %v, want net.ErrClosed", err)
+	}
+	if _, err := conn.Read(b); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read after Close: %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,23 @@
+module github.com/quietpleasure/server-tcp/otelserver
+
+go 1.23.0
+
+require (
+	github.com/maurice2k/tcpserver v1.2.0
+	github.com/quietpleasure/server-tcp v0.0.0
+	go.opentelemetry.io/otel v1.32.0
+	go.opentelemetry.io/otel/sdk v1.32.0
+	go.opentelemetry.io/otel/trace v1.32.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/maurice2k/ultrapool v1.1.1 // indirect
+	go.opentelemetry.io/otel/metric v1.32.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	golang.org/x/time v0.11.0 // indirect
+)
+
+replace github.com/quietpleasure/server-tcp => ../
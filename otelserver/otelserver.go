@@ -0,0 +1,58 @@
+// Package otelserver traces the connections of a server with OpenTelemetry.
+// It lives apart from the server package to keep OpenTelemetry out of the
+// core dependencies
+package otelserver
+
+import (
+	"fmt"
+
+	"github.com/maurice2k/tcpserver"
+	server "github.com/quietpleasure/server-tcp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Starts a server span for every connection before the handler runs and ends
+// it when the handler returns. The span carries the peer and local addresses
+// and the bytes transferred; the error a framing helper stopped with is
+// recorded as a span event. The handler finds the span in conn.GetContext(),
+// so its own spans become children of it
+func WithTracing(tracer trace.Tracer) server.Option {
+	return server.WithMiddleware(func(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+		return func(conn tcpserver.Connection) {
+			ctx, span := tracer.Start(*conn.GetContext(), "tcp.connection",
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("peer.address", conn.RemoteAddr().String()),
+					attribute.String("server.address", conn.LocalAddr().String()),
+				))
+			conn.SetContext(&ctx)
+			defer func() {
+				if r := recover(); r != nil {
+					span.SetStatus(codes.Error, fmt.Sprint("panic: ", r))
+					span.End()
+					panic(r)
+				}
+				end(span, conn)
+			}()
+			next(conn)
+		}
+	})
+}
+
+func end(span trace.Span, conn tcpserver.Connection) {
+	defer span.End()
+	rec, ok := server.ConnRecord(conn)
+	if !ok {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int64("bytes.read", rec.BytesRead),
+		attribute.Int64("bytes.written", rec.BytesWritten),
+	)
+	if rec.Err != nil {
+		span.RecordError(rec.Err)
+		span.SetStatus(codes.Error, rec.Err.Error())
+	}
+}
@@ -0,0 +1,65 @@
+package otelserver
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	server "github.com/quietpleasure/server-tcp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestWithTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	spans := make(chan trace.Span, 1)
+	s, err := server.New(
+		server.WithHost("127.0.0.1"),
+		server.WithPort(0),
+		WithTracing(provider.Tracer("test")),
+		server.WithRequestHandler(func(conn tcpserver.Connection) {
+			spans <- trace.SpanFromContext(*conn.GetContext())
+			conn.Write([]byte("hello"))
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.ReadAll(conn)
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	if span := <-spans; !span.SpanContext().IsValid() {
+		t.Fatal("handler context carries no span")
+	}
+	ended := recorder.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("%d spans ended, want 1", len(ended))
+	}
+	if ended[0].Name() != "tcp.connection" {
+		t.Fatalf("span name %q, want tcp.connection", ended[0].Name())
+	}
+	var written int64
+	for _, attr := range ended[0].Attributes() {
+		if attr.Key == "bytes.written" {
+			written = attr.Value.AsInt64()
+		}
+	}
+	if written != 5 {
+		t.Fatalf("bytes.written = %d, want 5", written)
+	}
+}
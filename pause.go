@@ -0,0 +1,78 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Holds new connections back while accepting is paused
+type gate struct {
+	mu sync.Mutex
+	// non-nil while paused, closed on resume
+	wait   chan struct{}
+	closed bool
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.wait == nil && !g.closed {
+		g.wait = make(chan struct{})
+	}
+}
+
+func (g *gate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.wait != nil {
+		close(g.wait)
+		g.wait = nil
+	}
+}
+
+// Releases held connections for good, they are turned away
+func (g *gate) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.resume()
+}
+
+// Blocks while paused. Reports false if the gate was closed meanwhile
+func (g *gate) pass() bool {
+	g.mu.Lock()
+	wait := g.wait
+	g.mu.Unlock()
+	if wait == nil {
+		return true
+	}
+	<-wait
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.closed
+}
+
+// Holds the connection until accepting is resumed
+func (s *Server) gateHandler(next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		if !s.gate.pass() {
+			return
+		}
+		next(conn)
+	}
+}
+
+// Stops admitting new connections while existing ones carry on. The listener
+// stays open, so clients can still connect, but their handler doesn't run until
+// ResumeAccept; connections still held back when shutdown begins are closed
+func (s *Server) PauseAccept() {
+	s.gate.pause()
+	s.log.Info("accept paused")
+}
+
+// Admits new connections again, including the ones held back since PauseAccept
+func (s *Server) ResumeAccept() {
+	s.gate.resume()
+	s.log.Info("accept resumed")
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPauseAccept(t *testing.T) {
+	s := startServer(t, WithRequestHandler(reply("hello")))
+	s.PauseAccept()
+	conn := dial(t, s.Addr())
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read while paused: %v, want a timeout", err)
+	}
+	s.ResumeAccept()
+	if got := readAll(t, conn); got != "hello" {
+		t.Errorf("held connection read %q, want hello", got)
+	}
+	if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+		t.Errorf("new connection read %q, want hello", got)
+	}
+}
+
+func TestPauseAcceptShutdown(t *testing.T) {
+	s := startServer(t, WithRequestHandler(reply("hello")))
+	s.PauseAccept()
+	conn := dial(t, s.Addr())
+	// lets the connection get accepted and held at the gate
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := io.ReadAll(conn); len(b) != 0 || err != nil {
+		t.Errorf("held connection read %q, %v, want it closed without the handler running", b, err)
+	}
+}
@@ -0,0 +1,24 @@
+module github.com/quietpleasure/server-tcp/promserver
+
+go 1.23.0
+
+require (
+	github.com/prometheus/client_golang v1.20.5
+	github.com/quietpleasure/server-tcp v0.0.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/maurice2k/tcpserver v1.2.0 // indirect
+	github.com/maurice2k/ultrapool v1.1.1 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	golang.org/x/time v0.11.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
+
+replace github.com/quietpleasure/server-tcp => ../
@@ -0,0 +1,54 @@
+// Package promserver reports the counters of a server to Prometheus. It is a
+// module of its own to keep the Prometheus client out of the core dependencies
+package promserver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	server "github.com/quietpleasure/server-tcp"
+)
+
+var (
+	activeDesc = prometheus.NewDesc("tcpserver_connections_active",
+		"Connections whose handler is running.", nil, nil)
+	acceptedDesc = prometheus.NewDesc("tcpserver_connections_accepted_total",
+		"Connections accepted.", nil, nil)
+	readDesc = prometheus.NewDesc("tcpserver_read_bytes_total",
+		"Bytes read by handlers.", nil, nil)
+	writtenDesc = prometheus.NewDesc("tcpserver_written_bytes_total",
+		"Bytes written by handlers.", nil, nil)
+	acceptErrorsDesc = prometheus.NewDesc("tcpserver_accept_errors_total",
+		"Failures that stopped the accept loop.", nil, nil)
+	panicsDesc = prometheus.NewDesc("tcpserver_handler_panics_total",
+		"Handler panics caught.", nil, nil)
+)
+
+// Reports the Stats counters to Prometheus, under the same names as the
+// WithAdminListener /metrics endpoint
+type collector struct {
+	s *server.Server
+}
+
+// Returns a collector for the counters of s, to register with a
+// prometheus.Registerer
+func Collector(s *server.Server) prometheus.Collector {
+	return collector{s: s}
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeDesc
+	ch <- acceptedDesc
+	ch <- readDesc
+	ch <- writtenDesc
+	ch <- acceptErrorsDesc
+	ch <- panicsDesc
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	st := c.s.Stats()
+	ch <- prometheus.MustNewConstMetric(activeDesc, prometheus.GaugeValue, float64(st.ActiveConnections))
+	ch <- prometheus.MustNewConstMetric(acceptedDesc, prometheus.CounterValue, float64(st.TotalAccepted))
+	ch <- prometheus.MustNewConstMetric(readDesc, prometheus.CounterValue, float64(st.TotalBytesRead))
+	ch <- prometheus.MustNewConstMetric(writtenDesc, prometheus.CounterValue, float64(st.TotalBytesWritten))
+	ch <- prometheus.MustNewConstMetric(acceptErrorsDesc, prometheus.CounterValue, float64(st.AcceptErrors))
+	ch <- prometheus.MustNewConstMetric(panicsDesc, prometheus.CounterValue, float64(st.HandlerPanics))
+}
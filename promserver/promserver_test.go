@@ -0,0 +1,39 @@
+package promserver
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	server "github.com/quietpleasure/server-tcp"
+)
+
+func TestCollector(t *testing.T) {
+	s, err := server.New()
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(Collector(s)); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, f := range families {
+		got[f.GetName()] = true
+	}
+	for _, name := range []string{
+		"tcpserver_connections_active",
+		"tcpserver_connections_accepted_total",
+		"tcpserver_read_bytes_total",
+		"tcpserver_written_bytes_total",
+		"tcpserver_accept_errors_total",
+		"tcpserver_handler_panics_total",
+	} {
+		if !got[name] {
+			t.Errorf("metric family %s missing", name)
+		}
+	}
+}
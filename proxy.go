@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Returned when a connection doesn't start with a valid PROXY protocol header
+var ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+// Longest possible v1 header including the trailing CRLF
+const proxyV1MaxLen = 107
+
+// How long a proxy gets to send the header when neither WithFirstByteTimeout
+// nor WithReadTimeout is set
+const proxyHeaderTimeout = 10 * time.Second
+
+// Signature opening every v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Addresses announced by a PROXY protocol header
+type ProxyHeader struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	// The proxy sent no client addresses (v1 UNKNOWN, v2 LOCAL command, an
+	// unsupported address family or a transport other than STREAM), so Source
+	// and Destination are the connection's own addresses
+	Local bool
+}
+
+type proxyHeaderKey struct{}
+
+// Returns the PROXY protocol header the connection started with
+func ProxyHeaderFrom(conn tcpserver.Connection) (*ProxyHeader, bool) {
+	h, ok := (*conn.GetContext()).Value(proxyHeaderKey{}).(*ProxyHeader)
+	return h, ok
+}
+
+// Connection whose header has been consumed, reporting the proxied addresses
+type proxyConn struct {
+	tcpserver.Connection
+	r      *bufio.Reader
+	header *ProxyHeader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.header.Source
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.header.Destination
+}
+
+func (c *proxyConn) GetClientAddr() *net.TCPAddr {
+	return c.header.Source
+}
+
+func (c *proxyConn) GetServerAddr() *net.TCPAddr {
+	return c.header.Destination
+}
+
+// Consumes the PROXY header and runs next with the proxied connection.
+// Connections without a valid header within timeout are closed
+func proxyHandler(log *slog.Logger, timeout time.Duration, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		r := bufio.NewReaderSize(conn, 256)
+		// read outside the connection wrapper, so its timeouts don't apply yet
+		err := conn.SetReadDeadline(time.Now().Add(timeout))
+		var header *ProxyHeader
+		if err == nil {
+			header, err = readProxyHeader(r, conn)
+		}
+		if err == nil {
+			err = conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			log.Warn("reject connection", "client", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+		ctx := context.WithValue(*conn.GetContext(), proxyHeaderKey{}, header)
+		conn.SetContext(&ctx)
+		next(&proxyConn{Connection: conn, r: r, header: header})
+	}
+}
+
+func readProxyHeader(r *bufio.Reader, conn tcpserver.Connection) (*ProxyHeader, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	if first[0] == proxyV2Signature[0] {
+		return readProxyV2(r, conn)
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("%w: header too long", ErrInvalidProxyHeader)
+		}
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	return parseProxyV1(line, conn)
+}
+
+// Reads the binary v2 header: signature, version/command, family/protocol,
+// address block length, addresses, and skips any TLVs
+func readProxyV2(r *bufio.Reader, conn tcpserver.Connection) (*ProxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	if !bytes.Equal(fixed[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: missing PROXY signature", ErrInvalidProxyHeader)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, fixed[12]>>4)
+	}
+	command := fixed[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidProxyHeader, command)
+	}
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+	size := int(binary.BigEndian.Uint16(fixed[14:]))
+
+	var ipLen int
+	switch family {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	}
+	if command == 0 || ipLen == 0 || transport != 1 {
+		// LOCAL command (health checks), addresses we can't represent or a
+		// transport other than STREAM
+		if _, err := r.Discard(size); err != nil {
+			return nil, fmt.Errorf("read proxy header: %w", err)
+		}
+		return &ProxyHeader{
+			Version:     2,
+			Source:      conn.GetClientAddr(),
+			Destination: conn.GetServerAddr(),
+			Local:       true,
+		}, nil
+	}
+
+	addrLen := 2*ipLen + 4
+	if size < addrLen {
+		return nil, fmt.Errorf("%w: address block too short", ErrInvalidProxyHeader)
+	}
+	addrs := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addrs); err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	if _, err := r.Discard(size - addrLen); err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	ports := addrs[2*ipLen:]
+	return &ProxyHeader{
+		Version: 2,
+		Source: &net.TCPAddr{
+			IP:   net.IP(addrs[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(ports[:2])),
+		},
+		Destination: &net.TCPAddr{
+			IP:   net.IP(addrs[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(ports[2:])),
+		},
+	}, nil
+}
+
+// Parses "PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n"
+// or "PROXY UNKNOWN ...\r\n"
+func parseProxyV1(line []byte, conn tcpserver.Connection) (*ProxyHeader, error) {
+	if len(line) > proxyV1MaxLen {
+		return nil, fmt.Errorf("%w: header too long", ErrInvalidProxyHeader)
+	}
+	line, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if !ok {
+		return nil, fmt.Errorf("%w: missing CRLF", ErrInvalidProxyHeader)
+	}
+	fields := strings.Split(string(line), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: missing PROXY signature", ErrInvalidProxyHeader)
+	}
+	if fields[1] == "UNKNOWN" {
+		return &ProxyHeader{
+			Version:     1,
+			Source:      conn.GetClientAddr(),
+			Destination: conn.GetServerAddr(),
+			Local:       true,
+		}, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: expected 6 fields, got %d", ErrInvalidProxyHeader, len(fields))
+	}
+
+	var v6 bool
+	switch fields[1] {
+	case "TCP4":
+	case "TCP6":
+		v6 = true
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidProxyHeader, fields[1])
+	}
+	src, err := parseProxyAddr(fields[2], fields[4], v6)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5], v6)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyHeader{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func parseProxyAddr(host, port string, v6 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() == nil) != v6 {
+		return nil, fmt.Errorf("%w: bad address %q", ErrInvalidProxyHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port %q", ErrInvalidProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handler writing the client address it sees
+func clientAddr(conn tcpserver.Connection) {
+	conn.Write([]byte(conn.RemoteAddr().String()))
+}
+
+func TestProxyV1(t *testing.T) {
+	s := startServer(t, WithProxyProtocol(), WithRequestHandler(clientAddr))
+	conn := dial(t, s.Addr())
+	conn.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"))
+	if got := readAll(t, conn); got != "192.0.2.1:56324" {
+		t.Fatalf("client address %q, want 192.0.2.1:56324", got)
+	}
+}
+
+func TestProxyV1Invalid(t *testing.T) {
+	s := startServer(t, WithProxyProtocol(), WithRequestHandler(clientAddr))
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n",
+		"PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+	} {
+		conn := dial(t, s.Addr())
+		conn.Write([]byte(header))
+		if got := readAll(t, conn); got != "" {
+			t.Errorf("header %q accepted, handler wrote %q", header, got)
+		}
+	}
+}
+
+func TestProxyV1Unknown(t *testing.T) {
+	s := startServer(t, WithProxyProtocol(), WithRequestHandler(clientAddr))
+	conn := dial(t, s.Addr())
+	conn.Write([]byte("PROXY UNKNOWN\r\n"))
+	if got, want := readAll(t, conn), conn.LocalAddr().String(); got != want {
+		t.Fatalf("client address %q, want the connection's own %q", got, want)
+	}
+}
+
+func TestProxyHeaderTimeout(t *testing.T) {
+	s := startServer(t, WithProxyProtocol(), WithFirstByteTimeout(100*time.Millisecond), WithRequestHandler(clientAddr))
+	conn := dial(t, s.Addr())
+	// stalls midway through the header
+	conn.Write([]byte("PROXY TCP4 192.0.2.1"))
+	begin := time.Now()
+	if got := readAll(t, conn); got != "" {
+		t.Fatalf("handler ran without a complete header, wrote %q", got)
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("stalled header held for %s", elapsed)
+	}
+}
+
+func TestProxyProtocolRejectsTLS(t *testing.T) {
+	if _, err := New(WithProxyProtocol(), WithSelfSignedTLS("localhost")); err == nil {
+		t.Fatal("New combined proxy protocol with tls")
+	}
+	s, err := New(WithProxyProtocol())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	cert, err := selfSignedCertificate([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}); err == nil {
+		t.Fatal("SetTLSConfig enabled tls on a proxy protocol server")
+	}
+}
+
+func TestProxyV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		local    bool
+	}{
+		{"stream", "\x11", false},
+		{"datagram", "\x12", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(chan *ProxyHeader, 1)
+			s := startServer(t, WithProxyProtocol(), WithRequestHandler(func(conn tcpserver.Connection) {
+				header, _ := ProxyHeaderFrom(conn)
+				headers <- header
+			}))
+			conn := dial(t, s.Addr())
+			conn.Write([]byte(string(proxyV2Signature) + "\x21" + tt.protocol + "\x00\x0c" +
+				"\xc0\x00\x02\x01" + "\xc0\x00\x02\x02" + "\xdc\x04\x01\xbb"))
+			var header *ProxyHeader
+			select {
+			case header = <-headers:
+			case <-time.After(time.Second):
+				t.Fatal("header rejected")
+			}
+			if header.Local != tt.local {
+				t.Fatalf("Local = %v, want %v", header.Local, tt.local)
+			}
+			if !tt.local && header.Source.String() != "192.0.2.1:56324" {
+				t.Fatalf("source %s, want 192.0.2.1:56324", header.Source)
+			}
+			if tt.local && !header.Source.IP.IsLoopback() {
+				t.Fatalf("source %s, want the connection's own address", header.Source)
+			}
+		})
+	}
+}
+
+func TestProxyV2LocalAndIPv6(t *testing.T) {
+	headers := make(chan *ProxyHeader, 1)
+	s := startServer(t, WithProxyProtocol(), WithRequestHandler(func(conn tcpserver.Connection) {
+		header, _ := ProxyHeaderFrom(conn)
+		headers <- header
+	}))
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"local", string(proxyV2Signature) + "\x20\x00\x00\x00", ""},
+		{"ipv6", string(proxyV2Signature) + "\x21\x21\x00\x24" + string(src) + string(dst) + "\xdc\x04\x01\xbb", "[2001:db8::1]:56324"},
+	}
+	for _, tt := range tests {
+		conn := dial(t, s.Addr())
+		conn.Write([]byte(tt.header))
+		select {
+		case header := <-headers:
+			if local := tt.want == ""; header.Local != local {
+				t.Errorf("%s: Local = %v, want %v", tt.name, header.Local, local)
+			}
+			if tt.want != "" && header.Source.String() != tt.want {
+				t.Errorf("%s: source %s, want %s", tt.name, header.Source, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: header rejected", tt.name)
+		}
+	}
+
+	conn := dial(t, s.Addr())
+	conn.Write([]byte(string(proxyV2Signature) + "\x31\x11\x00\x00"))
+	if readAll(t, conn); len(headers) != 0 {
+		t.Error("version 3 header accepted")
+	}
+}
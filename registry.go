@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Connections in flight, from the moment the server takes them until their
+// handler chain returns. Those that reached the handler are also registered
+// with their wrapper
+type registry struct {
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+	// sockets of the connections in flight, keyed by the tcpserver connection
+	inflight map[tcpserver.Connection]net.Conn
+	// closed while no connection is in flight
+	empty chan struct{}
+}
+
+func newRegistry() *registry {
+	empty := make(chan struct{})
+	close(empty)
+	return &registry{
+		conns:    make(map[*conn]struct{}),
+		inflight: make(map[tcpserver.Connection]net.Conn),
+		empty:    empty,
+	}
+}
+
+// Tracks c until leave, from before any layer of the handler chain runs
+func (r *registry) enter(c tcpserver.Connection) {
+	r.mu.Lock()
+	if len(r.inflight) == 0 {
+		r.empty = make(chan struct{})
+	}
+	r.inflight[c] = socketOf(c)
+	r.mu.Unlock()
+}
+
+func (r *registry) leave(c tcpserver.Connection) {
+	r.mu.Lock()
+	if _, ok := r.inflight[c]; ok {
+		delete(r.inflight, c)
+		if len(r.inflight) == 0 {
+			close(r.empty)
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *registry) add(c *conn) {
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *registry) remove(c *conn) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// Returns a channel that is closed once no connection is in flight
+func (r *registry) drained() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.empty
+}
+
+// Copy of the registered connections, so callers can use them without holding the lock
+func (r *registry) snapshot() []*conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]*conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Sockets of the connections in flight. Closing one is safe even after its
+// handler has returned
+func (r *registry) sockets() []net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sockets := make([]net.Conn, 0, len(r.inflight))
+	for _, s := range r.inflight {
+		sockets = append(sockets, s)
+	}
+	return sockets
+}
+
+// Remote addresses of the connections in flight: the client's as the handler
+// sees it for those registered, the peer's of the socket for the others
+func (r *registry) addrs() []net.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registered := make(map[tcpserver.Connection]*conn, len(r.conns))
+	for c := range r.conns {
+		registered[trackedConn(c)] = c
+	}
+	addrs := make([]net.Addr, 0, len(r.inflight))
+	for c, s := range r.inflight {
+		if wc, ok := registered[c]; ok {
+			addrs = append(addrs, wc.RemoteAddr())
+			continue
+		}
+		addrs = append(addrs, s.RemoteAddr())
+	}
+	return addrs
+}
+
+// Returns the connection the registry tracks for c, the one the handler chain
+// received before the server wrapped it
+func trackedConn(c tcpserver.Connection) tcpserver.Connection {
+	for {
+		switch v := c.(type) {
+		case *conn:
+			c = v.Connection
+		case *proxyConn:
+			c = v.Connection
+		default:
+			return c
+		}
+	}
+}
+
+// Writes data to every active connection, honouring the write timeout.
+// Under WithWriteBufferSize the handler's buffered writes are sent first and
+// data goes out right away, past the buffer. Returns the number of connections
+// the whole payload reached and the errors of the others
+func (s *Server) Broadcast(data []byte) (sent int, errs []error) {
+	for _, c := range s.conns.snapshot() {
+		if _, err := c.writeDirect(data, c.cfg.writeTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("broadcast to %s: %w", c.RemoteAddr(), err))
+			continue
+		}
+		sent++
+	}
+	return sent, errs
+}
+
+// Calls fn for each active connection until fn returns false. fn runs without
+// any lock held, so it may close the connection or call back into the server
+func (s *Server) ForEachConnection(fn func(conn tcpserver.Connection) bool) {
+	for _, c := range s.conns.snapshot() {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// Stops accepting and waits no longer than timeout for active connections to
+// finish. If timeout expires first, the remote addresses of the connections
+// still open are returned; they are left running. Use timeout = 0 to wait
+// indefinitely
+func (s *Server) Drain(timeout time.Duration) (remaining []net.Addr, err error) {
+	if err := s.Shutdown(timeout); err != nil {
+		return nil, err
+	}
+	if s.awaitDrain(drainDeadline(timeout)) {
+		return nil, nil
+	}
+	return s.conns.addrs(), nil
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Handler that blocks until release is closed
+func blocker(started chan<- struct{}, release <-chan struct{}) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		started <- struct{}{}
+		<-release
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s := startServer(t, WithRequestHandler(blocker(started, release)))
+	conns := []net.Conn{dial(t, s.Addr()), dial(t, s.Addr())}
+	<-started
+	<-started
+	sent, errs := s.Broadcast([]byte("news\n"))
+	if sent != 2 || len(errs) != 0 {
+		t.Fatalf("Broadcast = %d, %v, want 2, none", sent, errs)
+	}
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "news\n" {
+			t.Errorf("connection %d read %q, %v", i, line, err)
+		}
+	}
+}
+
+func TestForEachConnection(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s := startServer(t, WithRequestHandler(blocker(started, release)))
+	for range 3 {
+		dial(t, s.Addr())
+		<-started
+	}
+
+	var visited int
+	s.ForEachConnection(func(conn tcpserver.Connection) bool {
+		visited++
+		return true
+	})
+	if visited != 3 {
+		t.Errorf("visited %d connections, want 3", visited)
+	}
+
+	visited = 0
+	s.ForEachConnection(func(conn tcpserver.Connection) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("visited %d connections after returning false, want 1", visited)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s := startServer(t, WithRequestHandler(blocker(started, release)))
+	conn := dial(t, s.Addr())
+	<-started
+	begin := time.Now()
+	remaining, err := s.Drain(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Errorf("Drain returned after %v, before its timeout", elapsed)
+	}
+	if len(remaining) != 1 || remaining[0].String() != conn.LocalAddr().String() {
+		t.Errorf("remaining %v, want [%v]", remaining, conn.LocalAddr())
+	}
+
+	// connections still in an OnConnect callback haven't reached the handler yet
+	entered := make(chan struct{})
+	s = startServer(t, WithOnConnect(func(conn tcpserver.Connection) {
+		close(entered)
+		time.Sleep(300 * time.Millisecond)
+	}))
+	conn = dial(t, s.Addr())
+	<-entered
+	remaining, err = s.Drain(100 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].String() != conn.LocalAddr().String() {
+		t.Errorf("remaining %v with a connection in OnConnect, want [%v]", remaining, conn.LocalAddr())
+	}
+
+	s = startServer(t, WithRequestHandler(reply("hello")))
+	readAll(t, dial(t, s.Addr()))
+	if remaining, err := s.Drain(time.Second); err != nil || remaining != nil {
+		t.Errorf("Drain = %v, %v, want nothing remaining", remaining, err)
+	}
+}
+
+// Waits until n connections are registered
+func waitRegistered(t *testing.T, s *Server, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(s.conns.snapshot()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections registered, want %d", len(s.conns.snapshot()), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBroadcastWithWriteBuffer(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := startServer(t, WithWriteBufferSize(64), WithRequestHandler(func(conn tcpserver.Connection) {
+		conn.Write([]byte("hello "))
+		<-release
+	}))
+	conn := dial(t, s.Addr())
+	waitRegistered(t, s, 1)
+	sent, errs := s.Broadcast([]byte("all\n"))
+	if sent != 1 || len(errs) != 0 {
+		t.Fatalf("Broadcast = %d, %v, want 1, none", sent, errs)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if line != "hello all\n" {
+		t.Fatalf("got %q, want the buffered write followed by the broadcast", line)
+	}
+}
+
+func TestBroadcastWhileConnecting(t *testing.T) {
+	s := startServer(t, WithWriteBufferSize(64), WithRequestHandler(func(conn tcpserver.Connection) {
+		conn.Write([]byte("x"))
+	}))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Broadcast([]byte("y"))
+				runtime.Gosched()
+			}
+		}
+	}()
+	for range 20 {
+		readAll(t, dial(t, s.Addr()))
+	}
+	close(stop)
+	wg.Wait()
+}
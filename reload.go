@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Fields of options that Reload can apply to a running server
+var reloadable = map[string]bool{
+	"handler":         true,
+	"tlsConfig":       true,
+	"clientAuth":      true,
+	"sniCertificates": true,
+	"alpn":            true,
+	"tlsMinVersion":   true,
+	"tlsCipherSuites": true,
+	"readTimeout":     true,
+	"writeTimeout":    true,
+	"idleTimeout":     true,
+}
+
+// Fails for the first option set that Reload cannot apply
+func (opt *options) checkReloadable() error {
+	v := reflect.ValueOf(opt).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if !reloadable[name] && !v.Field(i).IsZero() {
+			return fmt.Errorf("option %s cannot be reloaded", name)
+		}
+	}
+	return nil
+}
+
+// Applies options to the running server without rebinding the listener or
+// dropping connections, as on SIGHUP. New connections pick up the change while
+// the ones being handled carry on with what they started with.
+// Reloadable are WithRequestHandler, WithReadTimeout, WithWriteTimeout,
+// WithIdleTimeout and the TLS options WithTLSConfig, WithTLSFromFiles,
+// WithSelfSignedTLS, WithClientCAs, WithSNICertificates, WithALPN,
+// WithTLSMinVersion and WithTLSCipherSuites, which replace the whole TLS config.
+// TLS can be reconfigured but not turned on or off. Any other option fails the
+// reload and nothing is applied. AwaitStopSignal stops on SIGHUP, so leave it
+// out with AwaitStopSignalWith when SIGHUP should trigger a reload instead
+func (s *Server) Reload(opts ...Option) error {
+	var opt options
+	for _, option := range opts {
+		if err := option(&opt); err != nil {
+			return err
+		}
+	}
+	if err := opt.checkReloadable(); err != nil {
+		return err
+	}
+	tlsConfig, err := opt.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && s.tls.Load() == nil {
+		return fmt.Errorf("tls cannot be enabled on a running server")
+	}
+
+	if opt.readTimeout != nil || opt.writeTimeout != nil || opt.idleTimeout != nil {
+		cc := *s.cc.Load()
+		if opt.readTimeout != nil {
+			cc.readTimeout = *opt.readTimeout
+		}
+		if opt.writeTimeout != nil {
+			cc.writeTimeout = *opt.writeTimeout
+		}
+		if opt.idleTimeout != nil {
+			cc.idleTimeout = *opt.idleTimeout
+		}
+		s.cc.Store(&cc)
+	}
+	if tlsConfig != nil {
+		s.tls.Store(tlsConfig)
+	}
+	if opt.handler != nil {
+		s.handler.Store(&opt.handler)
+	}
+	s.log.Info("reloaded")
+	return nil
+}
+
+// Swaps the request handler of a running server. Connections accepted from now
+// on use f, the ones being handled keep the handler they started with.
+// Middleware and the other options stay in place. Fails for a nil f, like
+// WithRequestHandler does
+func (s *Server) SetHandler(f tcpserver.RequestHandlerFunc) error {
+	if f == nil {
+		return fmt.Errorf("request handler cannot be nil")
+	}
+	s.handler.Store(&f)
+	return nil
+}
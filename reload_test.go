@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestReload(t *testing.T) {
+	s := startServer(t, WithRequestHandler(reply("old")))
+	if err := s.Reload(WithRequestHandler(reply("new")), WithReadTimeout(time.Second)); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := readAll(t, dial(t, s.Addr())); got != "new" {
+		t.Errorf("read %q after the reload, want new", got)
+	}
+	if got := s.cc.Load().readTimeout; got != time.Second {
+		t.Errorf("read timeout %v after the reload, want 1s", got)
+	}
+
+	// a single option that can't be reloaded fails the whole reload
+	if err := s.Reload(WithRequestHandler(reply("newer")), WithPort(1)); err == nil {
+		t.Error("Reload accepted WithPort")
+	}
+	if got := readAll(t, dial(t, s.Addr())); got != "new" {
+		t.Errorf("read %q after a failed reload, want new", got)
+	}
+	if err := s.Reload(WithSelfSignedTLS("localhost")); err == nil {
+		t.Error("Reload enabled tls on a plain server")
+	}
+}
+
+func TestReloadTLS(t *testing.T) {
+	s := startServer(t, WithSelfSignedTLS("first"), WithRequestHandler(reply("hello")))
+	if got := servedName(t, s); got != "first" {
+		t.Fatalf("served %q, want first", got)
+	}
+	if err := s.Reload(WithSelfSignedTLS("second")); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := servedName(t, s); got != "second" {
+		t.Errorf("served %q after the reload, want second", got)
+	}
+}
+
+func TestSetHandler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := startServer(t, WithRequestHandler(func(conn tcpserver.Connection) {
+		started <- struct{}{}
+		echo(conn)
+	}))
+	send := func(conn net.Conn, msg string) string {
+		conn.Write([]byte(msg))
+		closeWrite(conn)
+		return readAll(t, conn)
+	}
+	running := dial(t, s.Addr())
+	<-started
+	if err := s.SetHandler(func(conn tcpserver.Connection) {
+		b, _ := io.ReadAll(conn)
+		slices.Reverse(b)
+		conn.Write(b)
+	}); err != nil {
+		t.Fatalf("SetHandler: %v", err)
+	}
+	if got := send(dial(t, s.Addr()), "abc"); got != "cba" {
+		t.Errorf("new connection read %q, want cba", got)
+	}
+	if got := send(running, "abc"); got != "abc" {
+		t.Errorf("running connection read %q, want it to keep echoing", got)
+	}
+	if err := s.SetHandler(nil); err == nil {
+		t.Error("SetHandler accepted a nil handler")
+	}
+	if err := s.Reload(WithRequestHandler(nil)); err == nil {
+		t.Error("Reload accepted a nil handler")
+	}
+	if got := send(dial(t, s.Addr()), "abc"); got != "cba" {
+		t.Errorf("new connection read %q after the nil handler was refused, want cba", got)
+	}
+}
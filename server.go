@@ -1,237 +1,1680 @@
-package server
-
-import (
-	"fmt"
-	"net"
-	"os"
-	"os/signal"
-	"syscall"
-	"time"
-
-	"github.com/maurice2k/tcpserver"
-)
-
-type Server struct {
-	*tcpserver.Server
-}
-
-var default_host *net.IP
-
-type options struct {
-	host                   *net.IP
-	port                   *int
-	socketReusePort        *bool
-	socketFastOpen         *bool
-	socketFastOpenQueueLen *int
-	socketDeferAccept      *bool
-	loops                  *int
-	workerpoolShards       *int
-	allowThreadLocking     *bool
-	ballast                *int
-	handler                tcpserver.RequestHandlerFunc
-}
-
-type Option func(option *options) error
-
-func init() {
-	default_host = new(net.IP)
-	if err := default_host.UnmarshalText([]byte("127.0.0.1")); err != nil {
-		panic(err)
-	}
-}
-
-func New(opts ...Option) (*Server, error) {
-	var opt options
-	for _, option := range opts {
-		if err := option(&opt); err != nil {
-			return nil, err
-		}
-	}
-	host := default_host
-	if opt.host != nil {
-		host = opt.host
-	}
-	port := 0
-	if opt.port != nil {
-		port = *opt.port
-	}
-
-	address := fmt.Sprintf("%s:%d", *host, port)
-	if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
-		return nil, fmt.Errorf("validate tcp server address: %w", err)
-	}
-
-	srv, err := tcpserver.NewServer(address)
-	if err != nil {
-		return nil, fmt.Errorf("creates a new server instance: %w", err)
-	}
-
-	cfg := new(tcpserver.ListenConfig)
-	if opt.socketReusePort != nil {
-		cfg.SocketReusePort = *opt.socketReusePort
-	}
-	if opt.socketFastOpen != nil {
-		cfg.SocketFastOpen = *opt.socketFastOpen
-	}
-	if opt.socketFastOpenQueueLen != nil {
-		cfg.SocketFastOpenQueueLen = *opt.socketFastOpenQueueLen
-	}
-	if opt.loops != nil {
-		srv.SetLoops(*opt.loops)
-	}
-	if opt.workerpoolShards != nil {
-		srv.SetWorkerpoolShards(*opt.workerpoolShards)
-	}
-	if opt.allowThreadLocking != nil {
-		srv.SetAllowThreadLocking(*opt.allowThreadLocking)
-	}
-	if opt.ballast != nil {
-		srv.SetBallast(*opt.ballast)
-	}
-	// srv.SetMaxAcceptConnections()
-	// srv.SetContext(&ctx)
-	// srv.SetTLSConfig()
-
-	if opt.handler != nil {
-		srv.SetRequestHandler(opt.handler)
-	}
-
-	srv.SetListenConfig(cfg)
-
-	return &Server{srv}, nil
-}
-
-func (s *Server) Start() error {
-	if err := s.Listen(); err != nil {
-		return fmt.Errorf("error listening on interface: %w", err)
-	}
-
-	go func() {
-		s.Serve()
-	}()
-
-	return nil
-}
-
-func (s *Server) AwaitStopSignal(stopTimeout time.Duration) (os.Signal, error) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c,
-		os.Interrupt,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGHUP,
-		syscall.SIGQUIT,
-		syscall.SIGABRT)
-	sig := <-c
-
-	return sig, s.Shutdown(stopTimeout)
-}
-
-// default host=127.0.0.1
-func WithHost(host string) Option {
-	return func(options *options) error {
-		ip := new(net.IP)
-		if host == "" || host == "localhost" {
-			ip = default_host
-		} else {
-			if err := ip.UnmarshalText([]byte(host)); err != nil {
-				return err
-			}
-		}
-		options.host = ip
-		return nil
-	}
-}
-
-// if port=0 listening to random available port
-func WithPort(port int) Option {
-	return func(options *options) error {
-		if port < 0 {
-			return fmt.Errorf("port cannot be less than zero")
-		}
-		options.port = &port
-		return nil
-	}
-}
-
-// Enable/disable SO_REUSEPORT  (requires Linux >=2.4)
-func WithSocketReusePort(enable bool) Option {
-	return func(options *options) error {
-		options.socketReusePort = &enable
-		return nil
-	}
-}
-
-// Enable/disable TCP_FASTOPEN (requires Linux >=3.7 or Windows 10, version 1607)
-// For Linux:
-// - see https://lwn.net/Articles/508865/
-// - enable with "echo 3 >/proc/sys/net/ipv4/tcp_fastopen" for client and server
-// For Windows:
-// - enable with "netsh int tcp set global fastopen=enabled"
-func WithSocketFastOpen(enable bool) Option {
-	return func(options *options) error {
-		options.socketFastOpen = &enable
-		return nil
-	}
-}
-
-// Queue length for TCP_FASTOPEN (default 256)
-func WithSocketFastOpenQueueLen(len int) Option {
-	return func(options *options) error {
-		if len < 0 {
-			return fmt.Errorf("queue length cannot be less than zero")
-		}
-		options.socketFastOpenQueueLen = &len
-		return nil
-	}
-}
-
-// Enable/disable TCP_DEFER_ACCEPT (requires Linux >=2.4)
-func WithSocketDeferAccept(enable bool) Option {
-	return func(options *options) error {
-		options.socketDeferAccept = &enable
-		return nil
-	}
-}
-
-// Sets number of accept loops. Defaults to 4 which is more than enough for most use cases
-func WithLoops(loops int) Option {
-	return func(options *options) error {
-		options.loops = &loops
-		return nil
-	}
-}
-
-// Sets number of workerpool shards. Defaults to GOMAXPROCS*2
-func WithWorkerpoolShards(shards int) Option {
-	return func(options *options) error {
-		options.workerpoolShards = &shards
-		return nil
-	}
-}
-
-// Whether or not allow thread locking in accept loops
-func WithAllowThreadLocking(enable bool) Option {
-	return func(options *options) error {
-		options.allowThreadLocking = &enable
-		return nil
-	}
-}
-
-// This is kind of a hack to reduce GC cycles. Normally Go's GC kicks in whenever used memory doubles (see runtime.SetGCPercent() or GOGC env var: https://golang.org/pkg/runtime/debug/#SetGCPercent). With a very low memory footprint this might dramatically impact your performance, especially with lots of connections coming in waves.
-func WithBallast(sizeInMiB int) Option {
-	return func(options *options) error {
-		if sizeInMiB <= 0 {
-			return fmt.Errorf("ballast cannot be less than or equal to zero")
-		}
-		options.ballast = &sizeInMiB
-		return nil
-	}
-}
-
-func WithRequestHandler(f tcpserver.RequestHandlerFunc) Option {
-	return func(options *options) error {
-		options.handler = f
-		return nil
-	}
-}
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"golang.org/x/time/rate"
+)
+
+type Server struct {
+	*tcpserver.Server
+	serveErr chan error
+	done     chan struct{}
+	err      error
+	log      *slog.Logger
+	stats    counters
+	reloader *certReloader
+	conns    *registry
+	onAccept func(err *AcceptError)
+	grace    time.Duration
+	gate     gate
+	admin    *adminServer
+	onStart  []func(addr net.Addr)
+	retry    listenRetry
+	extra    []*tcpserver.Server
+	proxy    bool
+	// the assembled handler, shared by all listeners
+	chain tcpserver.RequestHandlerFunc
+	// swapped by Reload, loaded once per connection
+	handler atomic.Pointer[tcpserver.RequestHandlerFunc]
+	cc      atomic.Pointer[connConfig]
+	tls     atomic.Pointer[tls.Config]
+	// run once, when shutdown begins
+	onShutdown   []func()
+	shutdownOnce sync.Once
+	// when serving gives up waiting for connections, zero for never
+	drainBy time.Time
+	// cancels the WithContext context, nil without one
+	cancel context.CancelFunc
+}
+
+var default_host *net.IP
+
+// How often and how patiently to retry binding an address in use
+type listenRetry struct {
+	attempts int
+	backoff  time.Duration
+}
+
+type options struct {
+	host                   *net.IP
+	port                   *int
+	socketReusePort        *bool
+	socketFastOpen         *bool
+	socketFastOpenQueueLen *int
+	socketDeferAccept      *bool
+	loops                  *int
+	workerpoolShards       *int
+	allowThreadLocking     *bool
+	ballast                *int
+	tlsConfig              *tls.Config
+	clientAuth             *clientAuth
+	sniCertificates        sniCertificates
+	alpn                   []string
+	certReloader           *certReloader
+	tlsMinVersion          *uint16
+	tlsCipherSuites        []uint16
+	readBufferSize         *int
+	writeBufferSize        *int
+	bufferPool             *sync.Pool
+	ctx                    context.Context
+	maxAcceptConnections   *int32
+	readTimeout            *time.Duration
+	writeTimeout           *time.Duration
+	idleTimeout            *time.Duration
+	onConnect              []func(conn tcpserver.Connection)
+	onDisconnect           []func(conn tcpserver.Connection)
+	onPanic                func(conn tcpserver.Connection, r any, stack []byte)
+	middleware             []Middleware
+	logger                 *slog.Logger
+	maxConnectionsPerIP    *int
+	acceptRateLimit        *rate.Limiter
+	ipFilter               *ipFilter
+	connState              func(conn tcpserver.Connection, state ConnState)
+	sockopts               socketOptions
+	listenConfig           *tcpserver.ListenConfig
+	onError                func(conn tcpserver.Connection, err error)
+	proxyProtocol          bool
+	greeting               []byte
+	maxMessageSize         *int
+	onAcceptError          func(err *AcceptError)
+	forceCloseAfter        *time.Duration
+	onShutdown             []func()
+	onStart                []func(addr net.Addr)
+	handlerTimeout         *time.Duration
+	maxConcurrentHandlers  *int
+	handlerQueueTimeout    *time.Duration
+	readRateLimit          *int
+	writeRateLimit         *int
+	globalWriteRateLimit   *int
+	dispatcher             *dispatcher
+	healthCheckPath        string
+	adminAddr              *string
+	pprof                  bool
+	connectHooks           []func(conn tcpserver.Connection) error
+	firstByteTimeout       *time.Duration
+	listenRetry            *listenRetry
+	portRange              *[2]int
+	additionalListeners    []string
+	maxLifetime            *time.Duration
+	accessLog              *accessLog
+	handler                tcpserver.RequestHandlerFunc
+}
+
+type Option func(option *options) error
+
+func init() {
+	default_host = new(net.IP)
+	if err := default_host.UnmarshalText([]byte("127.0.0.1")); err != nil {
+		panic(err)
+	}
+}
+
+func New(opts ...Option) (*Server, error) {
+	var opt options
+	for _, option := range opts {
+		if err := option(&opt); err != nil {
+			return nil, err
+		}
+	}
+	if opt.socketFastOpenQueueLen != nil && (opt.socketFastOpen == nil || !*opt.socketFastOpen) {
+		return nil, fmt.Errorf("fast open queue length is set but fast open is not enabled")
+	}
+	if opt.pprof && opt.adminAddr == nil {
+		return nil, fmt.Errorf("pprof is enabled but there is no admin listener")
+	}
+	if opt.handlerQueueTimeout != nil && opt.maxConcurrentHandlers == nil {
+		return nil, fmt.Errorf("handler queue timeout is set but max concurrent handlers is not")
+	}
+	host := default_host
+	if opt.host != nil {
+		host = opt.host
+	}
+	port := 0
+	if opt.port != nil {
+		port = *opt.port
+	}
+	if opt.portRange != nil {
+		if opt.port != nil {
+			return nil, fmt.Errorf("port and port range cannot be combined")
+		}
+		free, err := firstFreePort(*host, opt.portRange[0], opt.portRange[1])
+		if err != nil {
+			return nil, err
+		}
+		port = free
+	}
+
+	address := net.JoinHostPort(host.String(), strconv.Itoa(port))
+	if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+		return nil, fmt.Errorf("validate tcp server address: %w", err)
+	}
+
+	srv, err := tcpserver.NewServer(address)
+	if err != nil {
+		return nil, fmt.Errorf("creates a new server instance: %w", err)
+	}
+
+	cfg := new(tcpserver.ListenConfig)
+	if opt.listenConfig != nil {
+		base := *opt.listenConfig
+		cfg = &base
+	}
+	if opt.socketReusePort != nil {
+		cfg.SocketReusePort = *opt.socketReusePort
+	}
+	if opt.socketFastOpen != nil {
+		cfg.SocketFastOpen = *opt.socketFastOpen
+	}
+	if opt.socketFastOpenQueueLen != nil {
+		cfg.SocketFastOpenQueueLen = *opt.socketFastOpenQueueLen
+	}
+	if opt.socketDeferAccept != nil {
+		cfg.SocketDeferAccept = *opt.socketDeferAccept
+	}
+	if opt.loops != nil {
+		srv.SetLoops(*opt.loops)
+	}
+	if opt.workerpoolShards != nil {
+		srv.SetWorkerpoolShards(*opt.workerpoolShards)
+	}
+	if opt.allowThreadLocking != nil {
+		srv.SetAllowThreadLocking(*opt.allowThreadLocking)
+	}
+	if opt.ballast != nil {
+		srv.SetBallast(*opt.ballast)
+	}
+	if opt.maxAcceptConnections != nil {
+		srv.SetMaxAcceptConnections(*opt.maxAcceptConnections)
+	}
+	tlsConfig, err := opt.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if opt.proxyProtocol && tlsConfig != nil {
+		return nil, fmt.Errorf("proxy protocol cannot be combined with tls")
+	}
+
+	logger := discardLogger
+	if opt.logger != nil {
+		logger = opt.logger
+	}
+
+	s := &Server{
+		Server:     srv,
+		serveErr:   make(chan error, 1),
+		done:       make(chan struct{}),
+		log:        logger,
+		reloader:   opt.certReloader,
+		conns:      newRegistry(),
+		onAccept:   opt.onAcceptError,
+		onStart:    opt.onStart,
+		onShutdown: opt.onShutdown,
+	}
+	if opt.ctx != nil {
+		ctx, cancel := context.WithCancel(opt.ctx)
+		srv.SetContext(&ctx)
+		s.cancel = cancel
+	}
+	if opt.forceCloseAfter != nil {
+		s.grace = *opt.forceCloseAfter
+	}
+	if opt.listenRetry != nil {
+		s.retry = *opt.listenRetry
+	}
+	if opt.adminAddr != nil {
+		s.admin = s.newAdminServer(*opt.adminAddr, opt.pprof)
+	}
+	if tlsConfig != nil {
+		s.tls.Store(tlsConfig)
+		srv.SetTLSConfig(&tls.Config{GetConfigForClient: s.tlsConfigForClient})
+	}
+
+	s.proxy = opt.proxyProtocol
+	cc := connConfig{
+		stats:     &s.stats,
+		onState:   opt.connState,
+		onError:   opt.onError,
+		registry:  s.conns,
+		greeting:  opt.greeting,
+		accessLog: opt.accessLog,
+	}
+	if opt.maxMessageSize != nil {
+		cc.maxMessageSize = *opt.maxMessageSize
+	}
+	if opt.sockopts.quickAck != nil {
+		cc.quickAck = *opt.sockopts.quickAck
+	}
+	if opt.readRateLimit != nil {
+		cc.readRate = *opt.readRateLimit
+	}
+	if opt.writeRateLimit != nil {
+		cc.writeRate = *opt.writeRateLimit
+	}
+	if opt.globalWriteRateLimit != nil {
+		cc.globalWrite = rate.NewLimiter(rate.Limit(*opt.globalWriteRateLimit), *opt.globalWriteRateLimit)
+	}
+	if opt.readTimeout != nil {
+		cc.readTimeout = *opt.readTimeout
+	}
+	if opt.writeTimeout != nil {
+		cc.writeTimeout = *opt.writeTimeout
+	}
+	if opt.idleTimeout != nil {
+		cc.idleTimeout = *opt.idleTimeout
+	}
+	if opt.maxLifetime != nil {
+		cc.maxLifetime = *opt.maxLifetime
+	}
+	if opt.firstByteTimeout != nil {
+		cc.firstByte = *opt.firstByteTimeout
+	}
+	cc.readers = opt.bufferPool
+	if cc.readers == nil {
+		size := defaultReadBufferSize
+		if opt.readBufferSize != nil {
+			size = *opt.readBufferSize
+		}
+		cc.readers = newReaderPool(size)
+	}
+	if opt.writeBufferSize != nil {
+		cc.writers = newWriterPool(*opt.writeBufferSize)
+	}
+
+	s.cc.Store(&cc)
+	if opt.handler != nil {
+		s.handler.Store(&opt.handler)
+	}
+	s.chain = s.buildHandler(&opt)
+	srv.SetRequestHandler(s.chain)
+
+	srv.SetListenConfig(cfg)
+
+	for _, addr := range opt.additionalListeners {
+		extra, err := s.newExtraListener(addr, &opt)
+		if err != nil {
+			return nil, err
+		}
+		s.extra = append(s.extra, extra)
+	}
+
+	return s, nil
+}
+
+func (s *Server) Start() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+
+	go s.serve()
+
+	return nil
+}
+
+// Listens and serves in the calling goroutine until the server is shut down,
+// as in log.Fatal(srv.ServeBlocking()). Returns nil after a graceful shutdown
+func (s *Server) ServeBlocking() error {
+	if err := s.listen(); err != nil {
+		return err
+	}
+	return s.serve()
+}
+
+func (s *Server) listen() error {
+	listen := s.Listen
+	if s.GetTLSConfig() != nil {
+		listen = s.ListenTLS
+	}
+	if s.admin != nil {
+		if err := s.admin.listen(s.log); err != nil {
+			return err
+		}
+	}
+	if err := s.bind(listen); err != nil {
+		if s.admin != nil {
+			s.admin.close()
+		}
+		return fmt.Errorf("error listening on interface: %w", err)
+	}
+	if err := s.listenExtra(); err != nil {
+		s.Server.Shutdown(0)
+		if s.admin != nil {
+			s.admin.close()
+		}
+		return err
+	}
+	s.log.Info("listening", "addr", s.Addr().String(), "tls", s.GetTLSConfig() != nil)
+	if s.reloader != nil {
+		go s.reloader.run(s.log, s.done)
+	}
+	for _, f := range s.onStart {
+		f(s.Addr())
+	}
+	return nil
+}
+
+// Returns the first port between low and high that host can be bound to
+func firstFreePort(host net.IP, low, high int) (int, error) {
+	network := "tcp4"
+	if host.To4() == nil {
+		network = "tcp6"
+	}
+	for port := low; port <= high; port++ {
+		l, err := net.Listen(network, net.JoinHostPort(host.String(), strconv.Itoa(port)))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port in range %d-%d", low, high)
+}
+
+// Calls listen, retrying with exponential backoff while the address is in use
+func (s *Server) bind(listen func() error) error {
+	backoff := s.retry.backoff
+	for i := 0; ; i++ {
+		err := listen()
+		if err == nil || i >= s.retry.attempts || !errors.Is(err, syscall.EADDRINUSE) {
+			return err
+		}
+		s.log.Warn("address in use, retrying", "attempt", i+1, "backoff", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *Server) serve() error {
+	var extra sync.WaitGroup
+	s.serveExtra(&extra)
+	err := s.Serve()
+	if err != nil {
+		err = s.acceptFailed(s.Addr(), err)
+		s.serveErr <- err
+	}
+	// takes the additional listeners down too if the main one stopped on its own
+	s.Shutdown(0)
+	extra.Wait()
+	s.awaitDrain(s.drainBy)
+	if s.cancel != nil {
+		// handlers still running past the drain deadline get to abort
+		s.cancel()
+	}
+	if s.admin != nil {
+		s.admin.close()
+	}
+	s.log.Info("stopped")
+	s.err = err
+	close(s.serveErr)
+	close(s.done)
+	return err
+}
+
+// Counts and reports the error an accept loop died with
+func (s *Server) acceptFailed(addr net.Addr, err error) *AcceptError {
+	acceptErr := &AcceptError{Addr: addr, Err: err}
+	s.stats.acceptErrors.Add(1)
+	s.log.Error("accept loop failed", "error", acceptErr)
+	if s.onAccept != nil {
+		s.onAccept(acceptErr)
+	}
+	return acceptErr
+}
+
+// Returns a channel that receives the error the accept loop died with, if any.
+// The channel is closed once serving stops, so after a graceful shutdown it is
+// closed without a value and a receive yields nil
+func (s *Server) ServeErr() <-chan error {
+	return s.serveErr
+}
+
+// Returns a channel that is closed once the server has stopped serving,
+// whether after a shutdown or because the accept loop failed
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Returns the error serving stopped with, nil after a graceful shutdown
+// or while the server is still serving
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Returns the address the server is actually bound to, which reveals the
+// assigned port when listening on port 0. Returns nil until the server is started
+func (s *Server) Addr() net.Addr {
+	if addr := s.GetListenAddr(); addr != nil {
+		return addr
+	}
+	return nil
+}
+
+// Gracefully shutdown server but wait no longer than d for active connections.
+// Use d = 0 to wait indefinitely for active connections.
+// Returns right away, the drain happens in the background (see Stop).
+// With WithForceCloseAfter, d is capped at the grace period and connections
+// still open when it ends are closed. Only the first call has an effect, and
+// the server calls it itself when the main listener stops on its own (the
+// WithMaxAcceptConnections limit or an accept failure)
+func (s *Server) Shutdown(d time.Duration) error {
+	if s.grace > 0 && (d == 0 || d > s.grace) {
+		d = s.grace
+	}
+	var err error
+	s.shutdownOnce.Do(func() {
+		s.gate.close()
+		for _, f := range s.onShutdown {
+			f()
+		}
+		s.log.Info("shutting down",
+			"active_connections", s.GetActiveConnections(),
+			"accepted_connections", s.GetAcceptedConnections(),
+			"timeout", d)
+		s.drainBy = drainDeadline(d)
+		// the registry tells when connections are done; given a deadline,
+		// tcpserver's Serve would sleep it out whenever one is active
+		if err = s.Server.Shutdown(0); errors.Is(err, net.ErrClosed) {
+			// a listener that stopped on its own is already closed
+			err = nil
+		}
+		if extraErr := s.shutdownExtra(0); err == nil {
+			err = extraErr
+		}
+		if s.grace > 0 {
+			go s.forceClose(d)
+		}
+	})
+	return err
+}
+
+// Closes the connections still open after d
+func (s *Server) forceClose(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.conns.drained():
+		return
+	case <-timer.C:
+	}
+	s.closeConnections()
+}
+
+// Hard closes every active connection
+func (s *Server) closeConnections() {
+	sockets := s.conns.sockets()
+	if len(sockets) == 0 {
+		return
+	}
+	s.log.Warn("force closing connections", "count", len(sockets))
+	for _, c := range sockets {
+		c.Close()
+	}
+}
+
+// Gracefully stops a started server: stops accepting and waits no longer than
+// timeout for active connections before returning. Use timeout = 0 to wait
+// indefinitely for active connections. Once they are done it also waits for
+// the server to stop serving, so Done is closed when Stop returns in time
+func (s *Server) Stop(timeout time.Duration) error {
+	if err := s.Shutdown(timeout); err != nil {
+		return err
+	}
+	if s.awaitDrain(drainDeadline(timeout)) {
+		<-s.done
+	}
+	return nil
+}
+
+// Deadline for waiting no longer than d, zero for waiting indefinitely when d is 0
+func drainDeadline(d time.Duration) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// Waits until no connection is active or deadline passes, reporting whether
+// the connections are done. A zero deadline waits indefinitely
+func (s *Server) awaitDrain(deadline time.Time) bool {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-s.conns.drained():
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+var default_stop_signals = []os.Signal{
+	os.Interrupt,
+	syscall.SIGINT,
+	syscall.SIGTERM,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGABRT,
+}
+
+// Blocks until SIGINT, SIGTERM, SIGHUP, SIGQUIT or SIGABRT arrives, then shuts the server down
+func (s *Server) AwaitStopSignal(stopTimeout time.Duration) (os.Signal, error) {
+	return s.AwaitStopSignalWith(stopTimeout, default_stop_signals...)
+}
+
+// Blocks until one of sigs arrives, then shuts the server down.
+// Signals not listed are left to their usual handling.
+// Without sigs the AwaitStopSignal defaults are used
+func (s *Server) AwaitStopSignalWith(stopTimeout time.Duration, sigs ...os.Signal) (os.Signal, error) {
+	if len(sigs) == 0 {
+		sigs = default_stop_signals
+	}
+	return s.awaitStopSignal(context.Background(), stopTimeout, sigs)
+}
+
+// Like AwaitStopSignal, but gives up when ctx is done and returns (nil, ctx.Err())
+// without shutting the server down
+func (s *Server) AwaitStopSignalContext(ctx context.Context, stopTimeout time.Duration) (os.Signal, error) {
+	return s.awaitStopSignal(ctx, stopTimeout, default_stop_signals)
+}
+
+func (s *Server) awaitStopSignal(ctx context.Context, stopTimeout time.Duration, sigs []os.Signal) (os.Signal, error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	defer signal.Stop(c)
+
+	select {
+	case sig := <-c:
+		return sig, s.Shutdown(stopTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returned by AwaitStopSignalAndDrain when a second signal cut the drain short
+var ErrForcedShutdown = errors.New("forced shutdown")
+
+// Like AwaitStopSignal, but also waits no longer than stopTimeout for active
+// connections to finish. A second signal during the wait closes them right away
+// and ErrForcedShutdown is returned with the first signal
+func (s *Server) AwaitStopSignalAndDrain(stopTimeout time.Duration) (os.Signal, error) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, default_stop_signals...)
+	defer signal.Stop(c)
+
+	sig := <-c
+	if err := s.Shutdown(stopTimeout); err != nil {
+		return sig, err
+	}
+	var expired <-chan time.Time
+	if stopTimeout > 0 {
+		timer := time.NewTimer(stopTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-s.conns.drained():
+	case <-expired:
+	case <-c:
+		s.closeConnections()
+		return sig, ErrForcedShutdown
+	}
+	return sig, nil
+}
+
+// default host=127.0.0.1
+// Accepts an IP literal or a hostname, which is resolved to its first address.
+// IPv6 addresses, "::" included, are bound IPv6-only: IPv4 clients cannot connect
+func WithHost(host string) Option {
+	return func(options *options) error {
+		ip := new(net.IP)
+		if host == "" || host == "localhost" {
+			ip = default_host
+		} else if err := ip.UnmarshalText([]byte(host)); err != nil {
+			addr, rerr := net.ResolveIPAddr("ip", host)
+			if rerr != nil {
+				return fmt.Errorf("resolve host %q: %w", host, rerr)
+			}
+			ip = &addr.IP
+		}
+		options.host = ip
+		return nil
+	}
+}
+
+// if port=0 listening to random available port
+func WithPort(port int) Option {
+	return func(options *options) error {
+		if port < 0 {
+			return fmt.Errorf("port cannot be less than zero")
+		}
+		if port > 65535 {
+			return fmt.Errorf("port cannot exceed 65535")
+		}
+		options.port = &port
+		return nil
+	}
+}
+
+// Enable/disable SO_REUSEPORT  (requires Linux >=2.4)
+func WithSocketReusePort(enable bool) Option {
+	return func(options *options) error {
+		options.socketReusePort = &enable
+		return nil
+	}
+}
+
+// Enable/disable TCP_FASTOPEN (requires Linux >=3.7 or Windows 10, version 1607)
+// For Linux:
+// - see https://lwn.net/Articles/508865/
+// - enable with "echo 3 >/proc/sys/net/ipv4/tcp_fastopen" for client and server
+// For Windows:
+// - enable with "netsh int tcp set global fastopen=enabled"
+func WithSocketFastOpen(enable bool) Option {
+	return func(options *options) error {
+		options.socketFastOpen = &enable
+		return nil
+	}
+}
+
+// Queue length for TCP_FASTOPEN (default 256)
+func WithSocketFastOpenQueueLen(len int) Option {
+	return func(options *options) error {
+		if len < 0 {
+			return fmt.Errorf("queue length cannot be less than zero")
+		}
+		options.socketFastOpenQueueLen = &len
+		return nil
+	}
+}
+
+// Enable/disable TCP_DEFER_ACCEPT (requires Linux >=2.4)
+func WithSocketDeferAccept(enable bool) Option {
+	return func(options *options) error {
+		options.socketDeferAccept = &enable
+		return nil
+	}
+}
+
+// Sets number of accept loops. Defaults to 4 which is more than enough for most use cases
+func WithLoops(loops int) Option {
+	return func(options *options) error {
+		options.loops = &loops
+		return nil
+	}
+}
+
+// Sets number of workerpool shards. Defaults to GOMAXPROCS*2
+func WithWorkerpoolShards(shards int) Option {
+	return func(options *options) error {
+		options.workerpoolShards = &shards
+		return nil
+	}
+}
+
+// Whether or not allow thread locking in accept loops
+func WithAllowThreadLocking(enable bool) Option {
+	return func(options *options) error {
+		options.allowThreadLocking = &enable
+		return nil
+	}
+}
+
+// This is kind of a hack to reduce GC cycles. Normally Go's GC kicks in whenever used memory doubles (see runtime.SetGCPercent() or GOGC env var: https://golang.org/pkg/runtime/debug/#SetGCPercent). With a very low memory footprint this might dramatically impact your performance, especially with lots of connections coming in waves.
+func WithBallast(sizeInMiB int) Option {
+	return func(options *options) error {
+		if sizeInMiB <= 0 {
+			return fmt.Errorf("ballast cannot be less than or equal to zero")
+		}
+		options.ballast = &sizeInMiB
+		return nil
+	}
+}
+
+// Sets maximum number of connections that are being accepted before the server automatically shutdowns
+func WithMaxAcceptConnections(n int) Option {
+	return func(options *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max accept connections must be greater than zero")
+		}
+		if n > math.MaxInt32 {
+			return fmt.Errorf("max accept connections cannot exceed %d", math.MaxInt32)
+		}
+		limit := int32(n)
+		options.maxAcceptConnections = &limit
+		return nil
+	}
+}
+
+// Bounds every read on a connection: the read deadline is pushed to now+d before
+// each Read. When a client stays silent longer than d the Read fails with
+// os.ErrDeadlineExceeded; a handler that returns on read errors then gets its
+// connection closed by the server
+func WithReadTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("read timeout must be greater than zero")
+		}
+		options.readTimeout = &d
+		return nil
+	}
+}
+
+// Bounds every write on a connection: the write deadline is pushed to now+d
+// before each Write, so it is refreshed as long as writes keep succeeding. A
+// client that stops reading makes the blocked Write fail with
+// os.ErrDeadlineExceeded instead of hanging forever
+func WithWriteTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("write timeout must be greater than zero")
+		}
+		options.writeTimeout = &d
+		return nil
+	}
+}
+
+// Closes connections that have neither read nor written anything for d.
+// The idle timer starts on accept and is reset by every read or write
+func WithIdleTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout must be greater than zero")
+		}
+		options.idleTimeout = &d
+		return nil
+	}
+}
+
+// Closes connections d after they were accepted, however busy they are, so
+// clients reconnect periodically and load balancers get to spread them anew.
+// Unlike WithIdleTimeout, activity doesn't postpone the close
+func WithMaxConnectionLifetime(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("max connection lifetime must be greater than zero")
+		}
+		options.maxLifetime = &d
+		return nil
+	}
+}
+
+// Registers a callback that runs for every accepted connection before the handler.
+// Can be given multiple times, callbacks run in registration order
+func WithOnConnect(f func(conn tcpserver.Connection)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("on connect callback cannot be nil")
+		}
+		options.onConnect = append(options.onConnect, f)
+		return nil
+	}
+}
+
+// Accepts on addr (host:port) as well, feeding the same handler with the same
+// options, for instance to serve an internal and an external interface or IPv4
+// and IPv6 side by side. Can be given multiple times. All listeners open with
+// Start and close with Shutdown; Addrs lists them. WithMaxAcceptConnections
+// and the accept loop failure reported by ServeErr apply to the main listener
+func WithAdditionalListener(addr string) Option {
+	return func(options *options) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listener address %q: %w", addr, err)
+		}
+		options.additionalListeners = append(options.additionalListeners, addr)
+		return nil
+	}
+}
+
+// Listens on the first free port between low and high inclusive, tried in
+// order; Addr reports the one picked. Ports are probed in New, so another
+// process may still take the port before Start. Cannot be combined with WithPort
+func WithPortRange(low, high int) Option {
+	return func(options *options) error {
+		if low <= 0 || high > 65535 {
+			return fmt.Errorf("port range must lie within 1-65535")
+		}
+		if low > high {
+			return fmt.Errorf("port range %d-%d is empty", low, high)
+		}
+		options.portRange = &[2]int{low, high}
+		return nil
+	}
+}
+
+// Retries binding up to attempts more times when the address is in use, as
+// happens during fast restarts, waiting backoff before the first retry and
+// twice as long before each next one. Other listen errors fail right away
+func WithListenRetry(attempts int, backoff time.Duration) Option {
+	return func(options *options) error {
+		if attempts <= 0 {
+			return fmt.Errorf("listen retry attempts must be greater than zero")
+		}
+		if backoff <= 0 {
+			return fmt.Errorf("listen retry backoff must be greater than zero")
+		}
+		options.listenRetry = &listenRetry{attempts: attempts, backoff: backoff}
+		return nil
+	}
+}
+
+// Closes connections whose first byte doesn't arrive within d of being accepted,
+// against clients that connect and then sit idle. Unlike WithReadTimeout it only
+// guards that window. The handler runs once the byte has arrived, so a protocol
+// where the server speaks first should send its banner with WithGreeting
+func WithFirstByteTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("first byte timeout must be greater than zero")
+		}
+		options.firstByteTimeout = &d
+		return nil
+	}
+}
+
+// Registers a policy check that runs for every accepted connection before the
+// OnConnect callbacks and the handler. Returning an error rejects the connection: it
+// is closed and the handler never runs. To tell the client why, the hook can
+// write a message before returning, for instance with CloseWithMessage.
+// Can be given multiple times, hooks run in registration order until one rejects
+func WithConnectHook(f func(conn tcpserver.Connection) error) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("connect hook cannot be nil")
+		}
+		options.connectHooks = append(options.connectHooks, f)
+		return nil
+	}
+}
+
+// Registers a callback that runs after the handler returns, even if it panicked.
+// Can be given multiple times, callbacks run in registration order
+func WithOnDisconnect(f func(conn tcpserver.Connection)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("on disconnect callback cannot be nil")
+		}
+		options.onDisconnect = append(options.onDisconnect, f)
+		return nil
+	}
+}
+
+// Recovers from panics in the handler so they don't take the process down.
+// The connection is closed and f receives the recovered value and the stack trace
+func WithRecover(f func(conn tcpserver.Connection, r any, stack []byte)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("recover callback cannot be nil")
+		}
+		options.onPanic = f
+		return nil
+	}
+}
+
+// Wraps the request handler in mw. The first middleware listed is the outermost,
+// so it runs first on the way in and last on the way out. Can be given multiple
+// times, later calls append further inside the chain. Under WithProtocolDispatch
+// the middleware wraps the dispatch, whichever handler it picks
+func WithMiddleware(mw ...Middleware) Option {
+	return func(options *options) error {
+		for _, m := range mw {
+			if m == nil {
+				return fmt.Errorf("middleware cannot be nil")
+			}
+		}
+		options.middleware = append(options.middleware, mw...)
+		return nil
+	}
+}
+
+// Structured logger for server events: listening, accept loop failures, handler
+// panics and shutdown. Nothing is logged by default
+func WithLogger(l *slog.Logger) Option {
+	return func(options *options) error {
+		if l == nil {
+			return fmt.Errorf("logger cannot be nil")
+		}
+		options.logger = l
+		return nil
+	}
+}
+
+// Limits the number of simultaneous connections from a single client IP.
+// Connections over the limit are closed right away without reaching the handler
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(options *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max connections per ip must be greater than zero")
+		}
+		options.maxConnectionsPerIP = &n
+		return nil
+	}
+}
+
+// Admits at most perSecond new connections per second into handlers, allowing
+// bursts of up to burst connections. Excess connections are closed right away
+func WithAcceptRateLimit(perSecond int, burst int) Option {
+	return func(options *options) error {
+		if perSecond <= 0 {
+			return fmt.Errorf("accept rate must be greater than zero")
+		}
+		if burst <= 0 {
+			return fmt.Errorf("accept burst must be greater than zero")
+		}
+		options.acceptRateLimit = rate.NewLimiter(rate.Limit(perSecond), burst)
+		return nil
+	}
+}
+
+// Filters connections by remote IP before anything else runs. Deny rules take
+// precedence over allow rules and an empty allow list allows everything not
+// denied. Rejected connections are closed right away
+func WithIPFilter(allow []net.IPNet, deny []net.IPNet) Option {
+	return func(options *options) error {
+		options.ipFilter = &ipFilter{allow: allow, deny: deny}
+		return nil
+	}
+}
+
+// Called whenever a connection changes state, modeled on http.Server.ConnState.
+// A connection goes New on accept, Active once bytes flow, Idle between messages
+// when the framing is known, and Closed when the handler returns
+func WithConnState(f func(conn tcpserver.Connection, state ConnState)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("conn state callback cannot be nil")
+		}
+		options.connState = f
+		return nil
+	}
+}
+
+// Sets SO_RCVBUF on accepted connections. The kernel may round or cap the value
+// (Linux doubles it and limits it to net.core.rmem_max)
+func WithSocketRecvBuffer(bytes int) Option {
+	return func(options *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("receive buffer size must be greater than zero")
+		}
+		options.sockopts.recvBuffer = &bytes
+		return nil
+	}
+}
+
+// Sets SO_SNDBUF on accepted connections. The kernel may round or cap the value
+// (Linux doubles it and limits it to net.core.wmem_max)
+func WithSocketSendBuffer(bytes int) Option {
+	return func(options *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("send buffer size must be greater than zero")
+		}
+		options.sockopts.sendBuffer = &bytes
+		return nil
+	}
+}
+
+// Enable/disable TCP_NODELAY on accepted connections, i.e. turn Nagle's algorithm off/on.
+// Go enables TCP_NODELAY by default, pass false to let small writes be coalesced
+func WithTCPNoDelay(enable bool) Option {
+	return func(options *options) error {
+		options.sockopts.noDelay = &enable
+		return nil
+	}
+}
+
+// Enable/disable SO_KEEPALIVE on accepted connections.
+// Go already enables it with a 15s period unless told otherwise
+func WithKeepAlive(enable bool) Option {
+	return func(options *options) error {
+		options.sockopts.keepAlive = &enable
+		return nil
+	}
+}
+
+// Sets the keepalive idle time and probe interval (TCP_KEEPIDLE and TCP_KEEPINTVL)
+// on accepted connections. Granularity is platform dependent: Linux and most
+// BSDs round up to whole seconds, Windows uses milliseconds, and older macOS
+// only honours the idle time
+func WithKeepAlivePeriod(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("keepalive period must be greater than zero")
+		}
+		options.sockopts.keepPeriod = &d
+		return nil
+	}
+}
+
+// Sets SO_LINGER on accepted connections.
+// d < 0 disables linger (close returns at once, pending data is sent in the background),
+// d = 0 makes close abortive (pending data is discarded and the peer gets a RST),
+// d > 0 makes close wait up to d, rounded up to whole seconds, for pending data to be sent
+func WithLinger(d time.Duration) Option {
+	return func(options *options) error {
+		sec := -1
+		if d >= 0 {
+			sec = int((d + time.Second - 1) / time.Second)
+		}
+		options.sockopts.linger = &sec
+		return nil
+	}
+}
+
+// Sets TCP_USER_TIMEOUT on accepted connections: the longest data may stay
+// unacknowledged before the kernel drops the connection, rounded down to whole
+// milliseconds. Unlike keepalive this also catches peers that vanish while data
+// is in flight. Linux only, New fails on other platforms
+func WithTCPUserTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if !linuxSocketOptions {
+			return fmt.Errorf("tcp user timeout is only supported on linux")
+		}
+		if d < time.Millisecond {
+			return fmt.Errorf("tcp user timeout must be at least one millisecond")
+		}
+		if d > math.MaxInt32*time.Millisecond {
+			return fmt.Errorf("tcp user timeout cannot exceed %s", math.MaxInt32*time.Millisecond)
+		}
+		options.sockopts.userTimeout = &d
+		return nil
+	}
+}
+
+// Enable/disable TCP_QUICKACK on accepted connections, acknowledging received
+// data at once rather than delaying the ack, which saves request/response
+// protocols waiting on it. Linux clears the flag again on its own, so with
+// enable the connection wrapper re-arms it after every read, at the cost of
+// a system call each. Linux only, New fails on other platforms
+func WithTCPQuickAck(enable bool) Option {
+	return func(options *options) error {
+		if !linuxSocketOptions {
+			return fmt.Errorf("tcp quick ack is only supported on linux")
+		}
+		options.sockopts.quickAck = &enable
+		return nil
+	}
+}
+
+// Marks the traffic of accepted connections with the given DSCP value (0-63)
+// for QoS, setting IP_TOS on IPv4 connections and IPV6_TCLASS on IPv6 ones.
+// The ECN bits are left clear. Linux only, New fails on other platforms
+func WithDSCP(value int) Option {
+	return func(options *options) error {
+		if !linuxSocketOptions {
+			return fmt.Errorf("dscp is only supported on linux")
+		}
+		if value < 0 || value > 63 {
+			return fmt.Errorf("dscp must lie within 0-63")
+		}
+		options.sockopts.dscp = &value
+		return nil
+	}
+}
+
+// Sets SO_MARK on accepted connections, tagging their packets with mark for
+// policy routing and netfilter. Needs CAP_NET_ADMIN, without it every
+// connection is closed. Linux only, New fails on other platforms
+func WithSocketMark(mark int) Option {
+	return func(options *options) error {
+		if !linuxSocketOptions {
+			return fmt.Errorf("socket mark is only supported on linux")
+		}
+		if mark < 0 || int64(mark) > math.MaxUint32 {
+			return fmt.Errorf("socket mark must lie within 0-%d", uint32(math.MaxUint32))
+		}
+		options.sockopts.mark = &mark
+		return nil
+	}
+}
+
+// Sets SO_PRIORITY on accepted connections, the priority their packets get in
+// the queueing disciplines. Values above 6 need CAP_NET_ADMIN, without it every
+// connection is closed. Linux only, New fails on other platforms
+func WithSocketPriority(prio int) Option {
+	return func(options *options) error {
+		if !linuxSocketOptions {
+			return fmt.Errorf("socket priority is only supported on linux")
+		}
+		if prio < 0 || prio > math.MaxInt32 {
+			return fmt.Errorf("socket priority must lie within 0-%d", math.MaxInt32)
+		}
+		options.sockopts.priority = &prio
+		return nil
+	}
+}
+
+// Uses a copy of cfg as the base listen config. The individual socket options
+// (WithSocketReusePort, WithSocketFastOpen, WithSocketFastOpenQueueLen,
+// WithSocketDeferAccept) take precedence over the matching fields of cfg,
+// regardless of the order the options are given in.
+// tcpserver installs its own control function on the listen socket, so raw socket
+// control is not available through the listen config (see WithControl)
+func WithListenConfig(cfg *tcpserver.ListenConfig) Option {
+	return func(options *options) error {
+		if cfg == nil {
+			return fmt.Errorf("listen config cannot be nil")
+		}
+		options.listenConfig = cfg
+		return nil
+	}
+}
+
+// Runs f against the raw socket of every accepted connection, after the other
+// socket options have been applied, to set options this package doesn't cover
+// (IP_TTL, TCP_CONGESTION, SO_BINDTODEVICE, ...). network and address describe the local end.
+// Can be given multiple times, functions run in registration order.
+// An error closes the connection
+func WithControl(f func(network, address string, c syscall.RawConn) error) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("control function cannot be nil")
+		}
+		options.sockopts.control = append(options.sockopts.control, f)
+		return nil
+	}
+}
+
+// Receives the error a framing helper (LengthPrefixedHandler, LineHandler,
+// JSONHandler, ...) stopped with before its connection is closed, such as
+// malformed input, an oversized message, a read failure or an error returned
+// by the message callback. A clean close by the peer is not reported
+func WithErrorHandler(f func(conn tcpserver.Connection, err error)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("error handler cannot be nil")
+		}
+		options.onError = f
+		return nil
+	}
+}
+
+// Expects every connection to start with a PROXY protocol header (text v1 or
+// binary v2), as sent by HAProxy, AWS NLB and other L4 proxies. The header is
+// consumed before the handler runs; RemoteAddr and GetClientAddr then report
+// the real client and ProxyHeaderFrom returns the decoded header. Connections
+// that don't start with a valid header are closed, as are those whose header
+// takes longer than WithFirstByteTimeout, else WithReadTimeout, else 10s to
+// arrive. Cannot be combined with TLS: the proxy sends the header ahead of the
+// TLS handshake, which tcpserver starts before any handler runs
+func WithProxyProtocol() Option {
+	return func(options *options) error {
+		options.proxyProtocol = true
+		return nil
+	}
+}
+
+// Size of the read buffer used by the framing helpers (default 4096).
+// Larger buffers mean fewer read syscalls for bulk traffic at the cost of memory per connection
+func WithReadBufferSize(bytes int) Option {
+	return func(options *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("read buffer size must be greater than zero")
+		}
+		options.readBufferSize = &bytes
+		return nil
+	}
+}
+
+// Buffers what handlers write to a connection, up to the given number of bytes,
+// so small writes leave as fewer and larger segments. The buffer is sent when
+// it fills up, on Flush, before the connection is read from and when the
+// handler returns. Off by default, writes then go out at once
+func WithWriteBufferSize(bytes int) Option {
+	return func(options *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("write buffer size must be greater than zero")
+		}
+		options.writeBufferSize = &bytes
+		return nil
+	}
+}
+
+// Pool the framing helpers take their buffered readers from, to share buffers
+// across servers. pool.New must return a *bufio.Reader; readers are reset before
+// use and put back when the handler returns, even if it panics.
+// Replaces the server's own pool, so WithReadBufferSize no longer applies
+func WithBufferPool(pool *sync.Pool) Option {
+	return func(options *options) error {
+		if pool == nil {
+			return fmt.Errorf("buffer pool cannot be nil")
+		}
+		options.bufferPool = pool
+		return nil
+	}
+}
+
+// Upper bound on any single message read by the framing helpers, on top of
+// their own limits. A larger message closes the connection and ErrMessageTooLarge
+// is passed to the WithErrorHandler callback
+func WithMaxMessageSize(bytes int) Option {
+	return func(options *options) error {
+		if bytes <= 0 {
+			return fmt.Errorf("max message size must be greater than zero")
+		}
+		options.maxMessageSize = &bytes
+		return nil
+	}
+}
+
+// Receives the error that stops the accept loop, as an *AcceptError. Temporary
+// accept errors are retried with backoff by the accept loop and never surface,
+// so in practice the callback sees permanent errors; ServeErr and Err still
+// report the same error afterwards
+func WithAcceptErrorHandler(f func(err *AcceptError)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("accept error handler cannot be nil")
+		}
+		options.onAcceptError = f
+		return nil
+	}
+}
+
+// Throttles reads to bytesPerSec on each connection, independently of the others
+func WithReadRateLimit(bytesPerSec int) Option {
+	return func(options *options) error {
+		if bytesPerSec <= 0 {
+			return fmt.Errorf("read rate limit must be greater than zero")
+		}
+		options.readRateLimit = &bytesPerSec
+		return nil
+	}
+}
+
+// Throttles writes to bytesPerSec on each connection, independently of the others.
+// Large writes are sent in chunks of at most bytesPerSec, WithWriteTimeout
+// applies to each chunk
+func WithWriteRateLimit(bytesPerSec int) Option {
+	return func(options *options) error {
+		if bytesPerSec <= 0 {
+			return fmt.Errorf("write rate limit must be greater than zero")
+		}
+		options.writeRateLimit = &bytesPerSec
+		return nil
+	}
+}
+
+// Caps the aggregate write throughput of all connections to bytesPerSec, on top
+// of any WithWriteRateLimit. Connections share the budget on a first come,
+// first served basis
+func WithGlobalWriteRateLimit(bytesPerSec int) Option {
+	return func(options *options) error {
+		if bytesPerSec <= 0 {
+			return fmt.Errorf("global write rate limit must be greater than zero")
+		}
+		options.globalWriteRateLimit = &bytesPerSec
+		return nil
+	}
+}
+
+// Ceiling on handlers running at once, across all connections. Connections
+// beyond it are accepted but wait for a running handler to return before theirs
+// starts; they wait indefinitely unless WithHandlerQueueTimeout is set
+func WithMaxConcurrentHandlers(n int) Option {
+	return func(options *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max concurrent handlers must be greater than zero")
+		}
+		options.maxConcurrentHandlers = &n
+		return nil
+	}
+}
+
+// How long a connection waits for a slot under WithMaxConcurrentHandlers before
+// it is closed without running the handler
+func WithHandlerQueueTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("handler queue timeout must be greater than zero")
+		}
+		options.handlerQueueTimeout = &d
+		return nil
+	}
+}
+
+// Hard cap on how long a handler may run per connection. The handler's context
+// (conn.GetContext()) expires after d and the connection is closed, regardless
+// of I/O activity, so blocked reads and writes fail
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("handler timeout must be greater than zero")
+		}
+		options.handlerTimeout = &d
+		return nil
+	}
+}
+
+// Registers a callback that runs once the listener is bound, before serving starts,
+// with the actual address (revealing the port picked for WithPort(0)).
+// Can be given multiple times, callbacks run in registration order
+func WithOnStart(f func(addr net.Addr)) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("on start callback cannot be nil")
+		}
+		options.onStart = append(options.onStart, f)
+		return nil
+	}
+}
+
+// Registers a callback that runs when shutdown begins, before connections are drained.
+// Can be given multiple times, callbacks run in registration order and only on
+// the first call to Shutdown or Stop, or when the server stops on its own
+func WithOnShutdown(f func()) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("on shutdown callback cannot be nil")
+		}
+		options.onShutdown = append(options.onShutdown, f)
+		return nil
+	}
+}
+
+// Bounds shutdown: Shutdown and Stop wait at most d for connections to drain,
+// even when given a longer or zero timeout, then close the ones still open.
+// A handler blocked on its connection returns once it is closed
+func WithForceCloseAfter(d time.Duration) Option {
+	return func(options *options) error {
+		if d <= 0 {
+			return fmt.Errorf("force close grace period must be greater than zero")
+		}
+		options.forceCloseAfter = &d
+		return nil
+	}
+}
+
+// Banner written to every connection before the handler runs, as SMTP and FTP
+// servers do. The write honors WithWriteTimeout; if it fails the connection is
+// closed without calling the handler
+func WithGreeting(banner []byte) Option {
+	return func(options *options) error {
+		if len(banner) == 0 {
+			return fmt.Errorf("greeting cannot be empty")
+		}
+		options.greeting = bytes.Clone(banner)
+		return nil
+	}
+}
+
+// Serves the net/http/pprof endpoints under /debug/pprof/ on the admin listener
+// (see WithAdminListener). Off by default: profiles expose internals and cost
+// CPU, so only enable it where the admin address is private
+func WithPprof(enable bool) Option {
+	return func(options *options) error {
+		options.pprof = enable
+		return nil
+	}
+}
+
+// Writes a line to w for every connection once it closes, rendered by format
+// or DefaultAccessFormat if format is nil. Writes are serialized, so w needn't
+// be safe for concurrent use
+func WithAccessLog(w io.Writer, format func(rec AccessRecord) string) Option {
+	return func(options *options) error {
+		if w == nil {
+			return fmt.Errorf("access log writer cannot be nil")
+		}
+		if format == nil {
+			format = DefaultAccessFormat
+		}
+		options.accessLog = &accessLog{w: w, format: format}
+		return nil
+	}
+}
+
+// Serves /metrics (the Stats counters in the Prometheus text format) and
+// /healthz over HTTP on a separate address, such as ":9100". The admin listener
+// opens with the server and closes once it has stopped serving; AdminAddr
+// reports where it is bound
+func WithAdminListener(addr string) Option {
+	return func(options *options) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid admin address %q: %w", addr, err)
+		}
+		options.adminAddr = &addr
+		return nil
+	}
+}
+
+// Answers HTTP probes on the main port: a connection starting with a GET request
+// for path gets a 200 OK reply and is closed without running the handler.
+// Anything else, HTTP or not, reaches the handler untouched. A connection that
+// sends nothing for 200ms, as clients of server-first protocols do, reaches the
+// handler after that delay
+func WithHealthCheck(path string) Option {
+	return func(options *options) error {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \r\n") {
+			return fmt.Errorf("health check path %q must start with / and contain no whitespace", path)
+		}
+		options.healthCheckPath = path
+		return nil
+	}
+}
+
+// Chooses the handler per connection from its first sniffLen bytes, for ports
+// serving several protocols (TLS or plaintext, HTTP or a custom protocol).
+// The bytes aren't consumed: the chosen handler reads the stream from the start.
+// When route returns nil the WithRequestHandler handler runs, or the connection
+// is closed if there is none. Peeking waits for sniffLen bytes unless the peer
+// closes first, so keep it to what the protocols always send up front
+func WithProtocolDispatch(sniffLen int, route func(peek []byte) tcpserver.RequestHandlerFunc) Option {
+	return func(options *options) error {
+		if sniffLen <= 0 {
+			return fmt.Errorf("sniff length must be greater than zero")
+		}
+		if route == nil {
+			return fmt.Errorf("route cannot be nil")
+		}
+		options.dispatcher = &dispatcher{sniffLen: sniffLen, route: route}
+		return nil
+	}
+}
+
+// Without a request handler accepted connections are just closed
+func WithRequestHandler(f tcpserver.RequestHandlerFunc) Option {
+	return func(options *options) error {
+		if f == nil {
+			return fmt.Errorf("request handler cannot be nil")
+		}
+		options.handler = f
+		return nil
+	}
+}
+
+// Accepted connections are wrapped in TLS using the given config.
+// The config must provide at least one certificate or a GetCertificate callback
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(options *options) error {
+		if cfg == nil {
+			return fmt.Errorf("tls config cannot be nil")
+		}
+		if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+			return fmt.Errorf("tls config must contain a certificate or a GetCertificate callback")
+		}
+		options.tlsConfig = cfg
+		return nil
+	}
+}
+
+// Loads a PEM encoded certificate and key pair from disk and serves TLS with it
+func WithTLSFromFiles(certPath, keyPath string) Option {
+	return func(options *options) error {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return fmt.Errorf("load tls key pair: %w", err)
+		}
+		options.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		return nil
+	}
+}
+
+// Verifies client certificates against pool (mutual TLS). With require set,
+// clients without a valid certificate are rejected during the handshake,
+// otherwise a certificate is only verified if the client sends one.
+// Requires TLS to be configured; see TLSConnectionState for reading the
+// client certificate in the handler
+func WithClientCAs(pool *x509.CertPool, require bool) Option {
+	return func(options *options) error {
+		if pool == nil {
+			return fmt.Errorf("client CA pool cannot be nil")
+		}
+		options.clientAuth = &clientAuth{pool: pool, require: require}
+		return nil
+	}
+}
+
+// Serves TLS with a certificate chosen by the SNI server name of each handshake.
+// Names match case-insensitively and may be wildcards like "*.example.com";
+// the entry under "" is the default for unknown or missing names. Without a
+// default, unknown names fall back to the certificates of WithTLSConfig, if
+// any, or fail the handshake
+func WithSNICertificates(certs map[string]tls.Certificate) Option {
+	return func(options *options) error {
+		if len(certs) == 0 {
+			return fmt.Errorf("sni certificates cannot be empty")
+		}
+		options.sniCertificates = make(sniCertificates, len(certs))
+		for name, cert := range certs {
+			options.sniCertificates[strings.ToLower(name)] = &cert
+		}
+		return nil
+	}
+}
+
+// Advertises protocols for ALPN negotiation, in order of preference.
+// Requires TLS to be configured; the handler finds the negotiated protocol in
+// TLSConnectionState(conn).NegotiatedProtocol
+func WithALPN(protocols ...string) Option {
+	return func(options *options) error {
+		if len(protocols) == 0 {
+			return fmt.Errorf("alpn needs at least one protocol")
+		}
+		for _, p := range protocols {
+			if p == "" || len(p) > 255 {
+				return fmt.Errorf("invalid alpn protocol %q", p)
+			}
+		}
+		options.alpn = append([]string(nil), protocols...)
+		return nil
+	}
+}
+
+// Serves TLS with the certificate and key at the given paths and checks them
+// every checkInterval, picking up rotated files for new handshakes without a
+// restart. A reload that fails (for example on a half-written file) is logged,
+// the previous certificate stays in use and the reload is retried on the next check
+func WithCertReloader(certPath, keyPath string, checkInterval time.Duration) Option {
+	return func(options *options) error {
+		if checkInterval <= 0 {
+			return fmt.Errorf("certificate check interval must be greater than zero")
+		}
+		r, err := newCertReloader(certPath, keyPath, checkInterval)
+		if err != nil {
+			return err
+		}
+		options.certReloader = r
+		return nil
+	}
+}
+
+// Minimum TLS version accepted from clients, e.g. tls.VersionTLS12.
+// Requires TLS to be configured
+func WithTLSMinVersion(v uint16) Option {
+	return func(options *options) error {
+		if v < tls.VersionTLS10 || v > tls.VersionTLS13 {
+			return fmt.Errorf("unknown tls version 0x%04x", v)
+		}
+		options.tlsMinVersion = &v
+		return nil
+	}
+}
+
+// Cipher suites enabled for TLS 1.0-1.2, e.g. tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+// TLS 1.3 suites are not configurable. Requires TLS to be configured
+func WithTLSCipherSuites(ids ...uint16) Option {
+	return func(options *options) error {
+		if len(ids) == 0 {
+			return fmt.Errorf("tls cipher suites cannot be empty")
+		}
+		for _, id := range ids {
+			if !knownCipherSuite(id) {
+				return fmt.Errorf("unknown tls cipher suite 0x%04x", id)
+			}
+		}
+		options.tlsCipherSuites = append([]uint16(nil), ids...)
+		return nil
+	}
+}
+
+// DEVELOPMENT ONLY. NEVER USE IN PRODUCTION.
+// Serves TLS with a throwaway self-signed certificate, generated in memory on
+// every New, for the given hostnames and IP addresses. Clients can't verify it
+// without InsecureSkipVerify or trusting it explicitly
+func WithSelfSignedTLS(hosts ...string) Option {
+	return func(options *options) error {
+		if len(hosts) == 0 {
+			return fmt.Errorf("self-signed certificate needs at least one host")
+		}
+		cert, err := selfSignedCertificate(hosts)
+		if err != nil {
+			return fmt.Errorf("self-signed certificate: %w", err)
+		}
+		options.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		return nil
+	}
+}
+
+// Parent context of the server. It is used for listening and is set on every
+// accepted connection, so handlers can watch *conn.GetContext() for cancellation
+// and abort in-flight work. Besides ctx itself ending, the server cancels it
+// when shutdown stops waiting: once connections have drained or, with work still
+// in flight, when the Shutdown or Stop timeout passes
+func WithContext(ctx context.Context) Option {
+	return func(options *options) error {
+		if ctx == nil {
+			return fmt.Errorf("context cannot be nil")
+		}
+		options.ctx = ctx
+		return nil
+	}
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestSocketDeferAccept(t *testing.T) {
+	for _, enable := range []bool{true, false} {
+		s, err := New(WithSocketDeferAccept(enable))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		if got := s.GetListenConfig().SocketDeferAccept; got != enable {
+			t.Fatalf("SocketDeferAccept = %v, want %v", got, enable)
+		}
+	}
+}
+
+// Starts a server on a random port of 127.0.0.1, stopped on test cleanup
+func startServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { s.Stop(time.Second) })
+	return s
+}
+
+// Connects to addr, the connection is closed on test cleanup
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Reads from conn until the peer closes it, failing after a second
+func readAll(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+// Handler writing msg and returning
+func reply(msg string) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		conn.Write([]byte(msg))
+	}
+}
+
+func TestIPv6Host(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		l.Close()
+	}
+	s := startServer(t, WithHost("::1"), WithRequestHandler(reply("hello")))
+	if ip := s.GetListenAddr().IP; !ip.Equal(net.IPv6loopback) {
+		t.Fatalf("listening on %s, want ::1", ip)
+	}
+	if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+}
+
+func TestServeErrClosedAfterStop(t *testing.T) {
+	s := startServer(t)
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case err, ok := <-s.ServeErr():
+		if ok {
+			t.Fatalf("ServeErr delivered %v after a graceful stop", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeErr not closed after Stop")
+	}
+}
+
+type testKey struct{}
+
+func TestContext(t *testing.T) {
+	values := make(chan any, 1)
+	ctx := context.WithValue(context.Background(), testKey{}, "parent")
+	s := startServer(t, WithContext(ctx), WithRequestHandler(func(conn tcpserver.Connection) {
+		values <- (*conn.GetContext()).Value(testKey{})
+	}))
+	dial(t, s.Addr())
+	if v := <-values; v != "parent" {
+		t.Fatalf("handler context value %v, want parent", v)
+	}
+}
+
+func TestContextCancelledAtDrainDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{})
+	s := startServer(t, WithContext(context.Background()), WithRequestHandler(func(conn tcpserver.Connection) {
+		started <- struct{}{}
+		<-(*conn.GetContext()).Done()
+		close(cancelled)
+	}))
+	dial(t, s.Addr())
+	<-started
+	if err := s.Stop(100 * time.Millisecond); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not cancelled after the drain deadline")
+	}
+}
+
+func TestMaxAcceptConnections(t *testing.T) {
+	if _, err := New(WithMaxAcceptConnections(0)); err == nil {
+		t.Fatal("New accepted a limit of 0")
+	}
+	s := startServer(t, WithMaxAcceptConnections(2), WithRequestHandler(reply("hello")))
+	for i := 0; i < 2; i++ {
+		if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+			t.Fatalf("connection %d read %q, want hello", i, got)
+		}
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server still serving after the accept limit")
+	}
+	if n := s.GetAcceptedConnections(); n != 2 {
+		t.Fatalf("accepted %d connections, want 2", n)
+	}
+}
+
+// Handler that signals started once it runs and then sleeps for d
+func sleeper(started chan<- struct{}, d time.Duration) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		started <- struct{}{}
+		time.Sleep(d)
+	}
+}
+
+func TestStopWaitsForActiveHandler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := startServer(t, WithRequestHandler(sleeper(started, 200*time.Millisecond)))
+	dial(t, s.Addr())
+	<-started
+	begin := time.Now()
+	if err := s.Stop(0); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+		t.Fatalf("Stop(0) returned after %s with a handler still running", elapsed)
+	}
+	if n := s.ActiveConnections(); n != 0 {
+		t.Fatalf("ActiveConnections() = %d after Stop, want 0", n)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Done not closed after Stop")
+	}
+}
+
+func TestStopReturnsOnceDrained(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := startServer(t, WithRequestHandler(sleeper(started, 50*time.Millisecond)))
+	dial(t, s.Addr())
+	<-started
+	begin := time.Now()
+	s.Stop(2 * time.Second)
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("Stop(2s) took %s for a 50ms handler", elapsed)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := startServer(t, WithRequestHandler(sleeper(started, time.Second)))
+	dial(t, s.Addr())
+	<-started
+	begin := time.Now()
+	s.Stop(100 * time.Millisecond)
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Fatalf("Stop(100ms) took %s with a 1s handler", elapsed)
+	}
+}
+
+func TestAddr(t *testing.T) {
+	s, err := New(WithPort(0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if addr := s.Addr(); addr != nil {
+		t.Fatalf("Addr() = %v before Start, want nil", addr)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer s.Stop(time.Second)
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("Addr() = %v after Start, want the bound port", s.Addr())
+	}
+	dial(t, addr)
+}
+
+func TestHostname(t *testing.T) {
+	name, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	ips, err := net.LookupIP(name)
+	if err != nil {
+		t.Skipf("hostname %s doesn't resolve: %v", name, err)
+	}
+	var opt options
+	if err := WithHost(name)(&opt); err != nil {
+		t.Fatalf("WithHost(%q): %v", name, err)
+	}
+	if !slices.ContainsFunc(ips, opt.host.Equal) {
+		t.Fatalf("%s resolved to %s, want one of %v", name, opt.host, ips)
+	}
+	if err := WithHost("no such host")(&opt); err == nil {
+		t.Fatal("WithHost accepted an unresolvable host")
+	}
+}
+
+func TestAwaitStopSignalContext(t *testing.T) {
+	s := startServer(t, WithRequestHandler(reply("hello")))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	sig, err := s.AwaitStopSignalContext(ctx, time.Second)
+	if sig != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("returned (%v, %v), want (nil, context deadline exceeded)", sig, err)
+	}
+	// still serving
+	if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+}
+
+func TestPortBounds(t *testing.T) {
+	for _, port := range []int{-1, 65536} {
+		if _, err := New(WithPort(port)); err == nil {
+			t.Errorf("New accepted port %d", port)
+		}
+	}
+	if _, err := New(WithPort(65535)); err != nil {
+		t.Errorf("New rejected port 65535: %v", err)
+	}
+}
+
+func TestFastOpenQueueLenNeedsFastOpen(t *testing.T) {
+	if _, err := New(WithSocketFastOpenQueueLen(16)); err == nil {
+		t.Error("New accepted a queue length without fast open")
+	}
+	if _, err := New(WithSocketFastOpen(false), WithSocketFastOpenQueueLen(16)); err == nil {
+		t.Error("New accepted a queue length with fast open disabled")
+	}
+	s, err := New(WithSocketFastOpenQueueLen(16), WithSocketFastOpen(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if n := s.GetListenConfig().SocketFastOpenQueueLen; n != 16 {
+		t.Errorf("SocketFastOpenQueueLen = %d, want 16", n)
+	}
+}
+
+func TestListenConfig(t *testing.T) {
+	cfg := &tcpserver.ListenConfig{SocketReusePort: true, SocketDeferAccept: true}
+	s, err := New(WithSocketDeferAccept(false), WithListenConfig(cfg))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got := s.GetListenConfig()
+	if !got.SocketReusePort {
+		t.Error("SocketReusePort of the listen config dropped")
+	}
+	// the dedicated option wins, whatever the order
+	if got.SocketDeferAccept {
+		t.Error("WithSocketDeferAccept(false) overridden by the listen config")
+	}
+	if !cfg.SocketDeferAccept {
+		t.Error("caller's listen config modified")
+	}
+	if _, err := New(WithListenConfig(nil)); err == nil {
+		t.Error("New accepted a nil listen config")
+	}
+}
+
+func TestServeBlocking(t *testing.T) {
+	started := make(chan net.Addr, 1)
+	s, err := New(WithOnStart(func(addr net.Addr) { started <- addr }), WithRequestHandler(reply("hello")))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.ServeBlocking() }()
+	addr := <-started
+	if got := readAll(t, dial(t, addr)); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+	s.Shutdown(time.Second)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("ServeBlocking returned %v after a graceful shutdown", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ServeBlocking still running after Shutdown")
+	}
+}
+
+func TestDone(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	s := startServer(t, WithRequestHandler(blocker(started, release)))
+	dial(t, s.Addr())
+	<-started
+	s.Shutdown(0)
+	select {
+	case <-s.Done():
+		t.Fatal("Done closed while a handler is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Done not closed once the handler returned")
+	}
+}
+
+func TestForceCloseAfter(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithForceCloseAfter(100*time.Millisecond), WithRequestHandler(readUntilError(errs)))
+	dial(t, s.Addr())
+	waitRegistered(t, s, 1)
+	begin := time.Now()
+	s.Stop(0)
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Stop(0) took %s with a 100ms grace period", elapsed)
+	}
+	if err := handlerError(t, errs); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("handler read error %v, want net.ErrClosed", err)
+	}
+	if _, err := New(WithForceCloseAfter(0)); err == nil {
+		t.Error("New accepted a zero grace period")
+	}
+}
+
+func TestOnShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var calls []string
+	var s *Server
+	s = startServer(t,
+		WithRequestHandler(blocker(started, release)),
+		WithOnShutdown(func() { calls = append(calls, "first") }),
+		WithOnShutdown(func() {
+			// connections haven't been drained yet
+			calls = append(calls, fmt.Sprint("second ", s.ActiveConnections()))
+			close(release)
+		}),
+	)
+	dial(t, s.Addr())
+	<-started
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	s.Shutdown(0)
+	if want := []string{"first", "second 1"}; !slices.Equal(calls, want) {
+		t.Errorf("callbacks %q, want %q", calls, want)
+	}
+	if _, err := New(WithOnShutdown(nil)); err == nil {
+		t.Error("New accepted a nil callback")
+	}
+}
+
+func TestOnStart(t *testing.T) {
+	var addrs []net.Addr
+	record := func(addr net.Addr) { addrs = append(addrs, addr) }
+	s := startServer(t, WithOnStart(record), WithOnStart(record))
+	if len(addrs) != 2 || addrs[0] != s.Addr() || addrs[1] != s.Addr() {
+		t.Fatalf("callbacks received %v, want %v twice", addrs, s.Addr())
+	}
+	if port := addrs[0].(*net.TCPAddr).Port; port == 0 {
+		t.Error("callback received port 0, want the picked port")
+	}
+	if _, err := New(WithOnStart(nil)); err == nil {
+		t.Error("New accepted a nil callback")
+	}
+}
+
+// Listens on a free port of 127.0.0.1 and returns the listener and the port
+func occupyPort(t *testing.T) (net.Listener, int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestListenRetry(t *testing.T) {
+	_, port := occupyPort(t)
+	s, err := New(WithPort(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("Start on a taken port: %v, want EADDRINUSE", err)
+	}
+
+	l, port := occupyPort(t)
+	time.AfterFunc(50*time.Millisecond, func() { l.Close() })
+	s = startServer(t, WithPort(port), WithListenRetry(5, 20*time.Millisecond), WithRequestHandler(reply("hello")))
+	if got := readAll(t, dial(t, s.Addr())); got != "hello" {
+		t.Errorf("read %q, want hello", got)
+	}
+
+	for _, opt := range []Option{WithListenRetry(0, time.Second), WithListenRetry(1, 0)} {
+		if _, err := New(opt); err == nil {
+			t.Error("New accepted an invalid listen retry")
+		}
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	_, taken := occupyPort(t)
+	if _, err := New(WithPortRange(taken, taken)); err == nil {
+		t.Error("New found a free port in a range of one taken port")
+	}
+	l, free := occupyPort(t)
+	l.Close()
+	s := startServer(t, WithPortRange(free, free))
+	if port := s.Addr().(*net.TCPAddr).Port; port != free {
+		t.Errorf("listening on port %d, want %d", port, free)
+	}
+
+	for _, r := range [][2]int{{0, 10}, {10, 65536}, {20, 10}} {
+		if _, err := New(WithPortRange(r[0], r[1])); err == nil {
+			t.Errorf("New accepted port range %d-%d", r[0], r[1])
+		}
+	}
+	if _, err := New(WithPort(free), WithPortRange(free, free)); err == nil {
+		t.Error("New accepted a port and a port range")
+	}
+}
+
+func TestIPv6HostIsIPv6Only(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		l.Close()
+	}
+	s := startServer(t, WithHost("::"), WithRequestHandler(reply("hello")))
+	port := s.GetListenAddr().Port
+	if got := readAll(t, dial(t, &net.TCPAddr{IP: net.IPv6loopback, Port: port})); got != "hello" {
+		t.Fatalf("IPv6 client read %q, want hello", got)
+	}
+	if conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second); err == nil {
+		conn.Close()
+		t.Error("IPv4 client connected to a server bound to ::")
+	}
+}
@@ -0,0 +1,58 @@
+// Package servertest runs servers on the loopback interface for tests
+package servertest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	server "github.com/quietpleasure/server-tcp"
+)
+
+// How long stop waits for active connections before giving up on them
+const stopTimeout = 5 * time.Second
+
+// Starts a server running handler on a random port of 127.0.0.1 and returns
+// its address. opts apply as given, except that the host and port are always
+// overridden. stop shuts the server down; it runs on test cleanup as well, so
+// calling it is only needed to stop the server early and is safe to repeat.
+// Fails the test if the server cannot be created or started
+func NewServer(t *testing.T, handler tcpserver.RequestHandlerFunc, opts ...server.Option) (addr string, stop func()) {
+	t.Helper()
+	opts = append(opts,
+		server.WithHost("127.0.0.1"),
+		server.WithPort(0),
+		server.WithRequestHandler(handler),
+	)
+	srv, err := server.New(opts...)
+	if err != nil {
+		t.Fatalf("servertest: create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("servertest: start server: %v", err)
+	}
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			if err := srv.Stop(stopTimeout); err != nil {
+				t.Errorf("servertest: stop server: %v", err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return srv.Addr().String(), stop
+}
+
+// Connects to addr, failing the test if that doesn't succeed within a second.
+// The connection is closed on test cleanup
+func Dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("servertest: dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
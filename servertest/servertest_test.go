@@ -0,0 +1,48 @@
+package servertest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func echo(conn tcpserver.Connection) {
+	io.Copy(conn, conn)
+}
+
+func TestEcho(t *testing.T) {
+	addr, _ := NewServer(t, echo)
+	conn := Dial(t, addr)
+	payload := []byte("hello, servertest")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("echoed %q, want %q", got, payload)
+	}
+}
+
+func TestStop(t *testing.T) {
+	addr, stop := NewServer(t, echo)
+	Dial(t, addr).Close()
+	begin := time.Now()
+	stop()
+	stop()
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("stop took %s", elapsed)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatal("server still accepts after stop")
+	}
+}
@@ -0,0 +1,87 @@
+//go:build unix
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Sends sig to the test process every few milliseconds until done is closed.
+// The signal is caught meanwhile, so it can't take the process down before the
+// server listens for it
+func signalUntil(t *testing.T, sig os.Signal, done <-chan struct{}) {
+	t.Helper()
+	caught := make(chan os.Signal, 1)
+	signal.Notify(caught, sig)
+	t.Cleanup(func() { signal.Stop(caught) })
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				self.Signal(sig)
+			}
+		}
+	}()
+}
+
+func TestAwaitStopSignalWith(t *testing.T) {
+	s := startServer(t)
+	done := make(chan struct{})
+	signalUntil(t, syscall.SIGUSR1, done)
+	sig, err := s.AwaitStopSignalWith(time.Second, syscall.SIGUSR1)
+	close(done)
+	if err != nil {
+		t.Fatalf("AwaitStopSignalWith: %v", err)
+	}
+	if sig != syscall.SIGUSR1 {
+		t.Fatalf("returned %v, want SIGUSR1", sig)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("server still serving after the signal")
+	}
+}
+
+func TestAwaitStopSignalAndDrain(t *testing.T) {
+	s := startServer(t)
+	done := make(chan struct{})
+	signalUntil(t, syscall.SIGTERM, done)
+	sig, err := s.AwaitStopSignalAndDrain(time.Second)
+	close(done)
+	if sig != syscall.SIGTERM || err != nil {
+		t.Fatalf("AwaitStopSignalAndDrain = %v, %v, want SIGTERM, nil", sig, err)
+	}
+}
+
+func TestAwaitStopSignalAndDrainForced(t *testing.T) {
+	errs := make(chan error, 1)
+	s := startServer(t, WithRequestHandler(readUntilError(errs)))
+	dial(t, s.Addr())
+	waitRegistered(t, s, 1)
+	done := make(chan struct{})
+	// keeps signalling, so a second signal arrives during the drain
+	signalUntil(t, syscall.SIGTERM, done)
+	sig, err := s.AwaitStopSignalAndDrain(10 * time.Second)
+	close(done)
+	if sig != syscall.SIGTERM || !errors.Is(err, ErrForcedShutdown) {
+		t.Fatalf("AwaitStopSignalAndDrain = %v, %v, want SIGTERM, ErrForcedShutdown", sig, err)
+	}
+	if err := handlerError(t, errs); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("handler read error %v, want net.ErrClosed", err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Socket options applied to every accepted connection. tcpserver owns the
+// listen socket's control function, so these are set right after accept
+type socketOptions struct {
+	recvBuffer *int
+	sendBuffer *int
+	noDelay    *bool
+	keepAlive  *bool
+	keepPeriod *time.Duration
+	linger     *int
+	// Linux only, see sockopt_linux.go
+	userTimeout *time.Duration
+	quickAck    *bool
+	dscp        *int
+	mark        *int
+	priority    *int
+	control     []func(network, address string, c syscall.RawConn) error
+}
+
+func (so *socketOptions) empty() bool {
+	return so.recvBuffer == nil && so.sendBuffer == nil && so.noDelay == nil &&
+		so.keepAlive == nil && so.keepPeriod == nil && so.linger == nil &&
+		so.userTimeout == nil && so.quickAck == nil &&
+		so.dscp == nil && so.mark == nil && so.priority == nil && len(so.control) == 0
+}
+
+func (so *socketOptions) apply(tc *net.TCPConn) error {
+	if so.recvBuffer != nil {
+		if err := tc.SetReadBuffer(*so.recvBuffer); err != nil {
+			return fmt.Errorf("set SO_RCVBUF: %w", err)
+		}
+	}
+	if so.sendBuffer != nil {
+		if err := tc.SetWriteBuffer(*so.sendBuffer); err != nil {
+			return fmt.Errorf("set SO_SNDBUF: %w", err)
+		}
+	}
+	if so.noDelay != nil {
+		if err := tc.SetNoDelay(*so.noDelay); err != nil {
+			return fmt.Errorf("set TCP_NODELAY: %w", err)
+		}
+	}
+	if so.keepAlive != nil || so.keepPeriod != nil {
+		// negative values leave the socket's current setting alone
+		ka := net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+		if so.keepAlive != nil {
+			ka.Enable = *so.keepAlive
+		}
+		if so.keepPeriod != nil {
+			ka.Idle = *so.keepPeriod
+			ka.Interval = *so.keepPeriod
+		}
+		if err := tc.SetKeepAliveConfig(ka); err != nil {
+			return fmt.Errorf("set keepalive: %w", err)
+		}
+	}
+	if so.linger != nil {
+		if err := tc.SetLinger(*so.linger); err != nil {
+			return fmt.Errorf("set SO_LINGER: %w", err)
+		}
+	}
+	if err := so.applyLinux(tc); err != nil {
+		return err
+	}
+	if len(so.control) > 0 {
+		rc, err := tc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		laddr := tc.LocalAddr()
+		for _, f := range so.control {
+			if err := f(laddr.Network(), laddr.String(), rc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the socket options before the handler runs. Connections whose
+// socket can't be configured are closed
+func (so *socketOptions) handler(log *slog.Logger, next tcpserver.RequestHandlerFunc) tcpserver.RequestHandlerFunc {
+	return func(conn tcpserver.Connection) {
+		if tc, ok := tcpConn(conn); ok {
+			if err := so.apply(tc); err != nil {
+				log.Error("apply socket options", "client", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+		}
+		next(conn)
+	}
+}
+
+// Returns the TCP socket underneath c, looking through the connection
+// wrappers and TLS
+func tcpConn(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		if tc, ok := c.(*net.TCPConn); ok {
+			return tc, true
+		}
+		inner, ok := innerConn(c)
+		if !ok {
+			return nil, false
+		}
+		c = inner
+	}
+}
+
+// Returns the connection c wraps, if c is one of the connection wrappers or TLS
+func innerConn(c net.Conn) (net.Conn, bool) {
+	switch v := c.(type) {
+	case *tcpserver.TCPConn:
+		return v.Conn, true
+	case *conn:
+		return v.Connection, true
+	case *proxyConn:
+		return v.Connection, true
+	case *tls.Conn:
+		return v.NetConn(), true
+	}
+	return nil, false
+}
+
+// Returns the socket c runs on, TLS included. Timers and shutdown close it
+// rather than c: once the handler returns tcpserver resets c and reuses it for
+// another client, while a closed socket stays closed
+func socketOf(c net.Conn) net.Conn {
+	for {
+		if tc, ok := c.(*tcpserver.TCPConn); ok {
+			return tc.Conn
+		}
+		inner, ok := innerConn(c)
+		if !ok {
+			return c
+		}
+		c = inner
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The Linux-only socket options can be used
+const linuxSocketOptions = true
+
+// Integer socket option to set
+type intSockopt struct {
+	name       string
+	level, opt int
+	value      int
+}
+
+// Applies the socket options only Linux has
+func (so *socketOptions) applyLinux(tc *net.TCPConn) error {
+	var opts []intSockopt
+	if so.userTimeout != nil {
+		opts = append(opts, intSockopt{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(so.userTimeout.Milliseconds())})
+	}
+	if so.quickAck != nil {
+		opts = append(opts, intSockopt{"TCP_QUICKACK", unix.IPPROTO_TCP, unix.TCP_QUICKACK, boolInt(*so.quickAck)})
+	}
+	if so.dscp != nil {
+		// DSCP is the upper six bits of the traffic class, the ECN bits stay clear
+		tos := *so.dscp << 2
+		if ip := tc.LocalAddr().(*net.TCPAddr).IP; ip.To4() != nil {
+			opts = append(opts, intSockopt{"IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, tos})
+		} else {
+			opts = append(opts, intSockopt{"IPV6_TCLASS", unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos})
+		}
+	}
+	if so.mark != nil {
+		opts = append(opts, intSockopt{"SO_MARK", unix.SOL_SOCKET, unix.SO_MARK, *so.mark})
+	}
+	if so.priority != nil {
+		opts = append(opts, intSockopt{"SO_PRIORITY", unix.SOL_SOCKET, unix.SO_PRIORITY, *so.priority})
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		for _, o := range opts {
+			if serr = unix.SetsockoptInt(int(fd), o.level, o.opt, o.value); serr != nil {
+				serr = fmt.Errorf("set %s: %w", o.name, serr)
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// Turns TCP_QUICKACK back on, as the kernel may have dropped back to delayed
+// acks. Errors are ignored: at worst an ack is delayed
+func rearmQuickAck(rc syscall.RawConn) {
+	rc.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_QUICKACK, 1)
+	})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
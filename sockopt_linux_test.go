@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+	"golang.org/x/sys/unix"
+)
+
+// Starts a server with opts and returns the value of the integer socket option
+// at level and opt on the server side of an accepted connection
+func acceptedSockopt(t *testing.T, level, opt int, opts ...Option) int {
+	t.Helper()
+	values := make(chan int, 1)
+	control := WithControl(func(network, address string, c syscall.RawConn) error {
+		var v int
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			v, serr = unix.GetsockoptInt(int(fd), level, opt)
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			t.Error(serr)
+		}
+		values <- v
+		return nil
+	})
+	s := startServer(t, append(opts, control)...)
+	dial(t, s.Addr())
+	select {
+	case v := <-values:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("no connection accepted")
+		return 0
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	// Linux doubles the requested size to leave room for bookkeeping
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_RCVBUF, WithSocketRecvBuffer(32<<10)); v != 64<<10 {
+		t.Errorf("SO_RCVBUF = %d, want %d", v, 64<<10)
+	}
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_SNDBUF, WithSocketSendBuffer(32<<10)); v != 64<<10 {
+		t.Errorf("SO_SNDBUF = %d, want %d", v, 64<<10)
+	}
+	if _, err := New(WithSocketRecvBuffer(0)); err == nil {
+		t.Error("New accepted a receive buffer of 0")
+	}
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		if v := acceptedSockopt(t, unix.IPPROTO_TCP, unix.TCP_NODELAY, WithTCPNoDelay(enable)); v != boolInt(enable) {
+			t.Errorf("WithTCPNoDelay(%v): TCP_NODELAY = %d", enable, v)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_KEEPALIVE, WithKeepAlive(false)); v != 0 {
+		t.Errorf("WithKeepAlive(false): SO_KEEPALIVE = %d", v)
+	}
+	period := WithKeepAlivePeriod(30 * time.Second)
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_KEEPALIVE, period); v != 1 {
+		t.Errorf("WithKeepAlivePeriod: SO_KEEPALIVE = %d, want 1", v)
+	}
+	if v := acceptedSockopt(t, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, period); v != 30 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 30", v)
+	}
+	if v := acceptedSockopt(t, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, period); v != 30 {
+		t.Errorf("TCP_KEEPINTVL = %d, want 30", v)
+	}
+	if _, err := New(WithKeepAlivePeriod(0)); err == nil {
+		t.Error("New accepted a keepalive period of 0")
+	}
+}
+
+func TestLinger(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want unix.Linger
+	}{
+		{-1, unix.Linger{Onoff: 0, Linger: 0}},
+		{0, unix.Linger{Onoff: 1, Linger: 0}},
+		{1500 * time.Millisecond, unix.Linger{Onoff: 1, Linger: 2}},
+	}
+	for _, tt := range tests {
+		lingers := make(chan unix.Linger, 1)
+		control := WithControl(func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				l, err := unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+				if err != nil {
+					t.Error(err)
+					l = &unix.Linger{}
+				}
+				lingers <- *l
+			})
+		})
+		// holds the connection open, as an abortive close could reset it mid-dial
+		drain := WithRequestHandler(func(conn tcpserver.Connection) { io.Copy(io.Discard, conn) })
+		s := startServer(t, WithLinger(tt.d), control, drain)
+		dial(t, s.Addr())
+		if got := <-lingers; got != tt.want {
+			t.Errorf("WithLinger(%s): SO_LINGER = %+v, want %+v", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	setTTL := WithControl(func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TTL, 42)
+		}); err != nil {
+			return err
+		}
+		return serr
+	})
+	// control functions run in registration order, the reading one last
+	if v := acceptedSockopt(t, unix.IPPROTO_IP, unix.IP_TTL, setTTL); v != 42 {
+		t.Errorf("IP_TTL = %d, want 42", v)
+	}
+
+	reject := WithControl(func(network, address string, c syscall.RawConn) error {
+		return errors.New("rejected")
+	})
+	s := startServer(t, reject, WithRequestHandler(reply("hello")))
+	if got := readAll(t, dial(t, s.Addr())); got != "" {
+		t.Fatalf("read %q although the control function failed", got)
+	}
+}
+
+func TestTCPUserTimeout(t *testing.T) {
+	if v := acceptedSockopt(t, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, WithTCPUserTimeout(1500*time.Millisecond)); v != 1500 {
+		t.Errorf("TCP_USER_TIMEOUT = %d, want 1500", v)
+	}
+	for _, d := range []time.Duration{0, time.Microsecond, (1 << 31) * time.Millisecond} {
+		if _, err := New(WithTCPUserTimeout(d)); err == nil {
+			t.Errorf("New accepted a tcp user timeout of %v", d)
+		}
+	}
+}
+
+func TestTCPQuickAck(t *testing.T) {
+	for _, enable := range []bool{false, true} {
+		if v := acceptedSockopt(t, unix.IPPROTO_TCP, unix.TCP_QUICKACK, WithTCPQuickAck(enable)); v != boolInt(enable) {
+			t.Errorf("WithTCPQuickAck(%v): TCP_QUICKACK = %d", enable, v)
+		}
+	}
+}
+
+func TestDSCP(t *testing.T) {
+	// EF, expedited forwarding
+	if v := acceptedSockopt(t, unix.IPPROTO_IP, unix.IP_TOS, WithDSCP(46)); v != 46<<2 {
+		t.Errorf("IP_TOS = %#x, want %#x", v, 46<<2)
+	}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		if v := acceptedSockopt(t, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, WithHost("::1"), WithDSCP(46)); v != 46<<2 {
+			t.Errorf("IPV6_TCLASS = %#x, want %#x", v, 46<<2)
+		}
+	}
+	for _, v := range []int{-1, 64} {
+		if _, err := New(WithDSCP(v)); err == nil {
+			t.Errorf("New accepted dscp %d", v)
+		}
+	}
+}
+
+func TestSocketMarkAndPriority(t *testing.T) {
+	// priorities up to 6 need no privileges
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_PRIORITY, WithSocketPriority(5)); v != 5 {
+		t.Errorf("SO_PRIORITY = %d, want 5", v)
+	}
+	for _, opt := range []Option{WithSocketMark(-1), WithSocketPriority(-1)} {
+		if _, err := New(opt); err == nil {
+			t.Error("New accepted an out of range value")
+		}
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, 1)
+	unix.Close(fd)
+	if err != nil {
+		t.Skipf("setting SO_MARK needs CAP_NET_ADMIN: %v", err)
+	}
+	if v := acceptedSockopt(t, unix.SOL_SOCKET, unix.SO_MARK, WithSocketMark(0x2a)); v != 0x2a {
+		t.Errorf("SO_MARK = %#x, want 0x2a", v)
+	}
+}
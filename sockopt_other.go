@@ -0,0 +1,17 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// The Linux-only socket options are rejected by New
+const linuxSocketOptions = false
+
+func (so *socketOptions) applyLinux(tc *net.TCPConn) error {
+	return nil
+}
+
+func rearmQuickAck(rc syscall.RawConn) {}
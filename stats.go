@@ -0,0 +1,126 @@
+package server
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Point-in-time snapshot of the server counters. AcceptErrors counts failures
+// that stopped the accept loop, HandlerPanics the handler panics caught while
+// WithRecover or WithLogger is set
+type Stats struct {
+	TotalAccepted     int64
+	ActiveConnections int64
+	TotalBytesRead    int64
+	TotalBytesWritten int64
+	AcceptErrors      int64
+	HandlerPanics     int64
+}
+
+// Lock-free counters updated from the handler path
+type counters struct {
+	accepted     atomic.Int64
+	active       atomic.Int64
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	acceptErrors atomic.Int64
+	panics       atomic.Int64
+	durations    durationHistogram
+}
+
+// Returns the number of connections whose handler is currently running
+func (s *Server) ActiveConnections() int64 {
+	return s.stats.active.Load()
+}
+
+// Returns a snapshot of the connection and traffic counters.
+// Only bytes read and written by handlers are counted
+func (s *Server) Stats() Stats {
+	return Stats{
+		TotalAccepted:     s.stats.accepted.Load(),
+		ActiveConnections: s.stats.active.Load(),
+		TotalBytesRead:    s.stats.bytesRead.Load(),
+		TotalBytesWritten: s.stats.bytesWritten.Load(),
+		AcceptErrors:      s.stats.acceptErrors.Load(),
+		HandlerPanics:     s.stats.panics.Load(),
+	}
+}
+
+// Publishes the counters as expvar variables for /debug/vars, named prefix
+// followed by total_accepted, active_connections, total_bytes_read,
+// total_bytes_written, accept_errors and handler_panics. Like expvar.Publish it
+// panics if a name is already taken, so call it once per prefix
+func (s *Server) PublishExpvars(prefix string) {
+	for name, counter := range map[string]*atomic.Int64{
+		"total_accepted":      &s.stats.accepted,
+		"active_connections":  &s.stats.active,
+		"total_bytes_read":    &s.stats.bytesRead,
+		"total_bytes_written": &s.stats.bytesWritten,
+		"accept_errors":       &s.stats.acceptErrors,
+		"handler_panics":      &s.stats.panics,
+	} {
+		expvar.Publish(prefix+name, expvar.Func(func() any {
+			return counter.Load()
+		}))
+	}
+}
+
+// Returns the 50th, 90th and 99th percentile of how long connections lasted,
+// from the handler starting to it returning, over all connections that have
+// finished. Durations are tracked in buckets a quarter of a doubling apart, so
+// each value is the upper bound of its bucket and overstates the exact
+// percentile by up to 19%. All zero until a connection has finished
+func (s *Server) DurationStats() (p50, p90, p99 time.Duration) {
+	counts, total := s.stats.durations.snapshot()
+	if total == 0 {
+		return 0, 0, 0
+	}
+	return percentile(counts, total, 0.50), percentile(counts, total, 0.90), percentile(counts, total, 0.99)
+}
+
+// Number of duration buckets, four per doubling from 1µs
+const durationBuckets = 145
+
+// Upper bounds of the duration buckets, from 1µs up to about 19 hours; the last
+// bucket also takes any longer duration
+var durationBounds = func() []time.Duration {
+	bounds := make([]time.Duration, durationBuckets)
+	for i := range bounds {
+		bounds[i] = time.Duration(math.Round(float64(time.Microsecond) * math.Pow(2, float64(i)/4)))
+	}
+	return bounds
+}()
+
+// Connection counts per duration bucket
+type durationHistogram struct {
+	counts [durationBuckets]atomic.Int64
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	i := sort.Search(len(durationBounds), func(i int) bool { return durationBounds[i] >= d })
+	h.counts[min(i, len(durationBounds)-1)].Add(1)
+}
+
+func (h *durationHistogram) snapshot() (counts [durationBuckets]int64, total int64) {
+	for i := range h.counts {
+		counts[i] = h.counts[i].Load()
+		total += counts[i]
+	}
+	return counts, total
+}
+
+// Upper bound of the bucket holding the q-quantile
+func percentile(counts [durationBuckets]int64, total int64, q float64) time.Duration {
+	rank := int64(math.Ceil(q * float64(total)))
+	var seen int64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			return durationBounds[i]
+		}
+	}
+	return durationBounds[len(durationBounds)-1]
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestActiveConnections(t *testing.T) {
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	s := startServer(t, WithRequestHandler(blocker(started, release)))
+	dial(t, s.Addr())
+	dial(t, s.Addr())
+	<-started
+	<-started
+	if n := s.ActiveConnections(); n != 2 {
+		t.Fatalf("ActiveConnections() = %d, want 2", n)
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for s.ActiveConnections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ActiveConnections() = %d after the handlers returned, want 0", s.ActiveConnections())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := startServer(t, WithRequestHandler(func(conn tcpserver.Connection) {
+		b := make([]byte, 4)
+		n, _ := io.ReadFull(conn, b)
+		conn.Write(b[:n])
+		conn.Write([]byte("!"))
+	}))
+	for i := 0; i < 2; i++ {
+		conn := dial(t, s.Addr())
+		conn.Write([]byte("ping"))
+		if got := readAll(t, conn); got != "ping!" {
+			t.Fatalf("read %q, want ping!", got)
+		}
+	}
+	if err := s.Stop(time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	got := s.Stats()
+	want := Stats{TotalAccepted: 2, TotalBytesRead: 8, TotalBytesWritten: 10}
+	if got != want {
+		t.Fatalf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestPublishExpvars(t *testing.T) {
+	s := startServer(t, WithRequestHandler(reply("hello")))
+	// names stay taken for the life of the process, so each run gets its own
+	prefix := fmt.Sprintf("test_%p_", s)
+	s.PublishExpvars(prefix)
+	readAll(t, dial(t, s.Addr()))
+	want := map[string]string{
+		"total_accepted":      "1",
+		"total_bytes_written": "5",
+		"active_connections":  "0",
+		"handler_panics":      "0",
+	}
+	for name, value := range want {
+		v := expvar.Get(prefix + name)
+		if v == nil {
+			t.Errorf("%s not published", name)
+			continue
+		}
+		if got := v.String(); got != value {
+			t.Errorf("%s = %s, want %s", name, got, value)
+		}
+	}
+}
+
+func TestDurationStats(t *testing.T) {
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p50, p90, p99 := s.DurationStats(); p50 != 0 || p90 != 0 || p99 != 0 {
+		t.Errorf("DurationStats() = %v, %v, %v before any connection, want zeros", p50, p90, p99)
+	}
+	for range 98 {
+		s.stats.durations.observe(time.Millisecond)
+	}
+	s.stats.durations.observe(100 * time.Millisecond)
+	s.stats.durations.observe(time.Second)
+	// bucket bounds overstate by at most 19%
+	within := func(got, want time.Duration) bool { return got >= want && got <= want*119/100 }
+	p50, p90, p99 := s.DurationStats()
+	if !within(p50, time.Millisecond) || !within(p90, time.Millisecond) || !within(p99, 100*time.Millisecond) {
+		t.Errorf("DurationStats() = %v, %v, %v, want about 1ms, 1ms, 100ms", p50, p90, p99)
+	}
+
+	var h durationHistogram
+	h.observe(100 * time.Hour)
+	if counts, _ := h.snapshot(); counts[durationBuckets-1] != 1 {
+		t.Error("duration past the last bound not counted in the last bucket")
+	}
+}
+
+func TestDurationStatsServed(t *testing.T) {
+	started := make(chan struct{}, 1)
+	s := startServer(t, WithRequestHandler(sleeper(started, 50*time.Millisecond)))
+	readAll(t, dial(t, s.Addr()))
+	deadline := time.Now().Add(time.Second)
+	for {
+		if p50, _, _ := s.DurationStats(); p50 >= 50*time.Millisecond {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("p50 = %v after a 50ms connection", p50)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
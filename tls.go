@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Returned by TLSConnectionState for connections that aren't TLS
+var ErrNotTLS = errors.New("connection is not tls")
+
+// Client certificate settings layered onto the TLS config
+type clientAuth struct {
+	pool    *x509.CertPool
+	require bool
+}
+
+// Returns the TLS config to serve with, or nil for plain TCP. The configured
+// tweaks are applied to a clone so the caller's config is left untouched
+func (opt *options) buildTLSConfig() (*tls.Config, error) {
+	base := opt.tlsConfig
+	if opt.sniCertificates != nil && opt.certReloader != nil {
+		return nil, fmt.Errorf("sni certificates and the certificate reloader cannot be combined")
+	}
+	if base == nil && (opt.sniCertificates != nil || opt.certReloader != nil) {
+		base = &tls.Config{}
+	}
+	if base == nil {
+		switch {
+		case opt.clientAuth != nil:
+			return nil, fmt.Errorf("client CAs require a tls config")
+		case opt.alpn != nil:
+			return nil, fmt.Errorf("alpn requires a tls config")
+		case opt.tlsMinVersion != nil:
+			return nil, fmt.Errorf("tls min version requires a tls config")
+		case opt.tlsCipherSuites != nil:
+			return nil, fmt.Errorf("tls cipher suites require a tls config")
+		}
+		return nil, nil
+	}
+	cfg := base.Clone()
+	if opt.sniCertificates != nil {
+		cfg.GetCertificate = opt.sniCertificates.get
+	}
+	if opt.certReloader != nil {
+		cfg.GetCertificate = opt.certReloader.get
+	}
+	if opt.clientAuth != nil {
+		cfg.ClientCAs = opt.clientAuth.pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if opt.clientAuth.require {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if opt.alpn != nil {
+		cfg.NextProtos = opt.alpn
+	}
+	if opt.tlsMinVersion != nil {
+		cfg.MinVersion = *opt.tlsMinVersion
+	}
+	if opt.tlsCipherSuites != nil {
+		cfg.CipherSuites = opt.tlsCipherSuites
+	}
+	return cfg, nil
+}
+
+// Hands every handshake the current config, so Reload can swap it while serving
+func (s *Server) tlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg := s.tls.Load()
+	if cfg.GetConfigForClient != nil {
+		if c, err := cfg.GetConfigForClient(hello); c != nil || err != nil {
+			return c, err
+		}
+	}
+	return cfg, nil
+}
+
+// Replaces the TLS config for new handshakes, to rotate certificates while
+// serving; established connections keep their session. The config must provide
+// a certificate with its private key or a GetCertificate callback. It replaces
+// WithClientCAs, WithALPN and the other TLS options as a whole (see Reload).
+// Called before Start it enables TLS; once serving, only a server that
+// serves TLS can be given a new config
+func (s *Server) SetTLSConfig(cfg *tls.Config) error {
+	if cfg == nil {
+		return fmt.Errorf("tls config cannot be nil")
+	}
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil {
+		return fmt.Errorf("tls config must contain a certificate or a GetCertificate callback")
+	}
+	for i, cert := range cfg.Certificates {
+		if len(cert.Certificate) == 0 || cert.PrivateKey == nil {
+			return fmt.Errorf("tls certificate %d lacks its certificate chain or private key", i)
+		}
+	}
+	if s.tls.Load() == nil {
+		if s.Addr() != nil {
+			return fmt.Errorf("tls cannot be enabled on a running server")
+		}
+		if s.proxy {
+			return fmt.Errorf("tls cannot be combined with proxy protocol")
+		}
+		s.Server.SetTLSConfig(&tls.Config{GetConfigForClient: s.tlsConfigForClient})
+	}
+	s.tls.Store(cfg.Clone())
+	s.log.Info("tls config replaced")
+	return nil
+}
+
+// Reports whether id names a cipher suite implemented by crypto/tls
+func knownCipherSuite(id uint16) bool {
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if cs.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Certificates keyed by lower-case server name, "" holding the default
+type sniCertificates map[string]*tls.Certificate
+
+// Picks the certificate for the requested server name: an exact match, then a
+// wildcard match for the first label, then the default. Returning nil lets
+// crypto/tls fall back to the config's Certificates or fail the handshake
+func (certs sniCertificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := certs[name]; ok && name != "" {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := certs["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return certs[""], nil
+}
+
+// Generates an in-memory ECDSA P-256 certificate, signed by itself, valid for
+// a year for the given hostnames and IP addresses
+func selfSignedCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial number: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"server-tcp self-signed"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Completes the TLS handshake if it hasn't happened yet and returns the
+// connection's TLS state, including verified client certificates and the
+// negotiated protocol
+func TLSConnectionState(conn tcpserver.Connection) (tls.ConnectionState, error) {
+	tc, ok := tlsConn(conn)
+	if !ok {
+		return tls.ConnectionState{}, ErrNotTLS
+	}
+	if err := tc.Handshake(); err != nil {
+		return tls.ConnectionState{}, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tc.ConnectionState(), nil
+}
+
+// Returns the TLS connection underneath c, looking through the connection wrappers
+func tlsConn(c net.Conn) (*tls.Conn, bool) {
+	for {
+		switch v := c.(type) {
+		case *tls.Conn:
+			return v, true
+		case *tcpserver.TCPConn:
+			c = v.Conn
+		case *conn:
+			c = v.Connection
+		case *proxyConn:
+			c = v.Connection
+		default:
+			return nil, false
+		}
+	}
+}
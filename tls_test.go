@@ -0,0 +1,351 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Self-signed certificate for hosts
+func testCert(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	cert, err := selfSignedCertificate(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Pool trusting the given self-signed certificates
+func certPool(certs ...tls.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert.Leaf)
+	}
+	return pool
+}
+
+// Completes a TLS handshake with addr, the connection is closed on test cleanup
+func dialTLS(t *testing.T, addr net.Addr, cfg *tls.Config) (*tls.Conn, error) {
+	t.Helper()
+	conn := dial(t, addr)
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(time.Second))
+	return tc, tc.Handshake()
+}
+
+func TestTLSConfig(t *testing.T) {
+	cert := testCert(t, "127.0.0.1")
+	s := startServer(t, WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}), WithRequestHandler(reply("hello")))
+	conn, err := dialTLS(t, s.Addr(), &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := readAll(t, conn); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	if _, err := New(WithTLSConfig(nil)); err == nil {
+		t.Fatal("New accepted a nil tls config")
+	}
+	if _, err := New(WithTLSConfig(&tls.Config{})); err == nil {
+		t.Fatal("New accepted a tls config without certificates")
+	}
+}
+
+// Writes cert and its key as PEM files into a temporary directory
+func writeCertFiles(t *testing.T, cert tls.Certificate) (certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, cert, certPath, keyPath)
+	return certPath, keyPath
+}
+
+// Writes cert and its key as PEM files to the given paths
+func writeCert(t *testing.T, cert tls.Certificate, certPath, keyPath string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSFromFiles(t *testing.T) {
+	cert := testCert(t, "127.0.0.1")
+	certPath, keyPath := writeCertFiles(t, cert)
+	s := startServer(t, WithTLSFromFiles(certPath, keyPath), WithRequestHandler(reply("hello")))
+	conn, err := dialTLS(t, s.Addr(), &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := readAll(t, conn); got != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+
+	if _, err := New(WithTLSFromFiles(filepath.Join(t.TempDir(), "missing.pem"), keyPath)); err == nil {
+		t.Fatal("New accepted a missing certificate file")
+	}
+}
+
+// Self-signed client certificate for mutual TLS
+func clientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// Handler writing the common name of the verified client certificate, or none
+func peerName(conn tcpserver.Connection) {
+	state, err := TLSConnectionState(conn)
+	if err != nil {
+		return
+	}
+	name := "none"
+	if len(state.PeerCertificates) > 0 {
+		name = state.PeerCertificates[0].Subject.CommonName
+	}
+	conn.Write([]byte(name))
+}
+
+// Reads what the server sends over TLS, "" if the handshake or read fails
+func readTLS(t *testing.T, addr net.Addr, cfg *tls.Config) string {
+	t.Helper()
+	conn, err := dialTLS(t, addr, cfg)
+	if err != nil {
+		return ""
+	}
+	b, _ := io.ReadAll(conn)
+	return string(b)
+}
+
+func TestClientCAs(t *testing.T) {
+	serverCert, client := testCert(t, "127.0.0.1"), clientCert(t, "client")
+	tlsConfig := WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	withCert := &tls.Config{RootCAs: certPool(serverCert), ServerName: "127.0.0.1", Certificates: []tls.Certificate{client}}
+	withoutCert := &tls.Config{RootCAs: certPool(serverCert), ServerName: "127.0.0.1"}
+
+	required := startServer(t, tlsConfig, WithClientCAs(certPool(client), true), WithRequestHandler(peerName))
+	if got := readTLS(t, required.Addr(), withCert); got != "client" {
+		t.Errorf("required, with certificate: read %q, want client", got)
+	}
+	if got := readTLS(t, required.Addr(), withoutCert); got != "" {
+		t.Errorf("required, without certificate: read %q, want a failed handshake", got)
+	}
+
+	optional := startServer(t, tlsConfig, WithClientCAs(certPool(client), false), WithRequestHandler(peerName))
+	if got := readTLS(t, optional.Addr(), withoutCert); got != "none" {
+		t.Errorf("optional, without certificate: read %q, want none", got)
+	}
+	untrusted := clientCert(t, "stranger")
+	withUntrusted := &tls.Config{RootCAs: certPool(serverCert), ServerName: "127.0.0.1",
+		// sent although it doesn't match the CAs the server asks for
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &untrusted, nil
+		}}
+	if got := readTLS(t, optional.Addr(), withUntrusted); got != "" {
+		t.Errorf("optional, untrusted certificate: read %q, want a failed handshake", got)
+	}
+
+	if _, err := New(WithClientCAs(certPool(client), true)); err == nil {
+		t.Error("New accepted client CAs without tls")
+	}
+}
+
+func TestSNICertificates(t *testing.T) {
+	s := startServer(t, WithSNICertificates(map[string]tls.Certificate{
+		"a.example.com": testCert(t, "a.example.com"),
+		"*.example.org": testCert(t, "*.example.org"),
+		"":              testCert(t, "default"),
+	}), WithRequestHandler(reply("hello")))
+	tests := []struct{ serverName, want string }{
+		{"a.example.com", "a.example.com"},
+		{"A.Example.COM", "a.example.com"},
+		{"b.example.org", "*.example.org"},
+		{"b.example.net", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tests {
+		conn, err := dialTLS(t, s.Addr(), &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("%q: handshake: %v", tt.serverName, err)
+			continue
+		}
+		if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != tt.want {
+			t.Errorf("%q: served %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestALPN(t *testing.T) {
+	cert := testCert(t, "127.0.0.1")
+	s := startServer(t,
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		WithALPN("h2", "myproto/1"),
+		WithRequestHandler(func(conn tcpserver.Connection) {
+			if state, err := TLSConnectionState(conn); err == nil {
+				conn.Write([]byte(state.NegotiatedProtocol))
+			}
+		}),
+	)
+	client := &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1", NextProtos: []string{"myproto/1", "h2"}}
+	// the server's preference wins
+	if got := readTLS(t, s.Addr(), client); got != "h2" {
+		t.Errorf("negotiated %q, want h2", got)
+	}
+	client.NextProtos = []string{"myproto/1"}
+	if got := readTLS(t, s.Addr(), client); got != "myproto/1" {
+		t.Errorf("negotiated %q, want myproto/1", got)
+	}
+
+	if _, err := New(WithALPN("h2")); err == nil {
+		t.Error("New accepted alpn without tls")
+	}
+	if _, err := New(WithALPN("")); err == nil {
+		t.Error("New accepted an empty protocol")
+	}
+}
+
+func TestTLSMinVersionAndCipherSuites(t *testing.T) {
+	cert := testCert(t, "127.0.0.1")
+	tlsConfig := WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	client := func(max uint16, suites ...uint16) *tls.Config {
+		return &tls.Config{RootCAs: certPool(cert), ServerName: "127.0.0.1", MaxVersion: max, CipherSuites: suites}
+	}
+
+	s := startServer(t, tlsConfig, WithTLSMinVersion(tls.VersionTLS13), WithRequestHandler(reply("hello")))
+	if _, err := dialTLS(t, s.Addr(), client(tls.VersionTLS12)); err == nil {
+		t.Error("TLS 1.2 client admitted under a TLS 1.3 minimum")
+	}
+	if _, err := dialTLS(t, s.Addr(), client(tls.VersionTLS13)); err != nil {
+		t.Errorf("TLS 1.3 client: %v", err)
+	}
+
+	suite := uint16(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	s = startServer(t, tlsConfig, WithTLSCipherSuites(suite), WithRequestHandler(reply("hello")))
+	if _, err := dialTLS(t, s.Addr(), client(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305)); err == nil {
+		t.Error("client without the enabled suite admitted")
+	}
+	conn, err := dialTLS(t, s.Addr(), client(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, suite))
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := conn.ConnectionState().CipherSuite; got != suite {
+		t.Errorf("negotiated %s, want %s", tls.CipherSuiteName(got), tls.CipherSuiteName(suite))
+	}
+
+	if _, err := New(WithTLSMinVersion(0x0305)); err == nil {
+		t.Error("New accepted an unknown tls version")
+	}
+	if _, err := New(WithTLSCipherSuites(0xffff)); err == nil {
+		t.Error("New accepted an unknown cipher suite")
+	}
+}
+
+func TestSelfSignedTLS(t *testing.T) {
+	s := startServer(t, WithSelfSignedTLS("localhost", "127.0.0.1"), WithRequestHandler(reply("hello")))
+	conn, err := dialTLS(t, s.Addr(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if got := readAll(t, conn); got != "hello" {
+		t.Errorf("read %q, want %q", got, "hello")
+	}
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := New(WithSelfSignedTLS()); err == nil {
+		t.Error("New accepted a self-signed certificate without hosts")
+	}
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	first, second := testCert(t, "first"), testCert(t, "second")
+	s, err := New(WithRequestHandler(reply("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// before Start it turns TLS on
+	if err := s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{first}}); err != nil {
+		t.Fatalf("SetTLSConfig before Start: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Stop(time.Second) })
+	if got := servedName(t, s); got != "first" {
+		t.Fatalf("served %q, want first", got)
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{second}}
+	if err := s.SetTLSConfig(cfg); err != nil {
+		t.Fatalf("SetTLSConfig: %v", err)
+	}
+	cfg.Certificates = []tls.Certificate{first}
+	if got := servedName(t, s); got != "second" {
+		t.Errorf("served %q after the swap, want second", got)
+	}
+
+	for name, cfg := range map[string]*tls.Config{
+		"nil":            nil,
+		"no certificate": {},
+		"missing key":    {Certificates: []tls.Certificate{{Certificate: second.Certificate}}},
+		"missing chain":  {Certificates: []tls.Certificate{{PrivateKey: second.PrivateKey}}},
+	} {
+		if err := s.SetTLSConfig(cfg); err == nil {
+			t.Errorf("SetTLSConfig accepted a config with %s", name)
+		}
+	}
+
+	plain := startServer(t)
+	if err := plain.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{first}}); err == nil {
+		t.Error("SetTLSConfig enabled tls on a running plain server")
+	}
+}
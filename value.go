@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+// Attaches value to the connection under key, replacing an earlier value.
+// Values live in the connection's context, so they are visible to the
+// OnConnect/OnDisconnect callbacks and the handler alike. key must be comparable
+// and should be of an unexported type, as with context.WithValue
+func SetConnValue(conn tcpserver.Connection, key, value any) {
+	ctx := context.WithValue(*conn.GetContext(), key, value)
+	conn.SetContext(&ctx)
+}
+
+// Returns the value attached to the connection under key, or nil
+func GetConnValue(conn tcpserver.Connection, key any) any {
+	return (*conn.GetContext()).Value(key)
+}
+
+// Typed key for connection values, saving the type assertion on every read
+type ConnKey[T any] struct {
+	name string
+}
+
+// Creates a key; every call yields a distinct key, name is only for debugging
+func NewConnKey[T any](name string) *ConnKey[T] {
+	return &ConnKey[T]{name: name}
+}
+
+func (k *ConnKey[T]) String() string {
+	return "server.ConnKey(" + k.name + ")"
+}
+
+// Attaches v to the connection under k
+func (k *ConnKey[T]) Set(conn tcpserver.Connection, v T) {
+	SetConnValue(conn, k, v)
+}
+
+// Returns the value attached under k and whether there was one
+func (k *ConnKey[T]) Get(conn tcpserver.Connection) (T, bool) {
+	v, ok := GetConnValue(conn, k).(T)
+	return v, ok
+}
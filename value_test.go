@@ -0,0 +1,30 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/maurice2k/tcpserver"
+)
+
+func TestConnValue(t *testing.T) {
+	user := NewConnKey[string]("user")
+	other := NewConnKey[string]("user")
+	s := startServer(t,
+		WithOnConnect(func(conn tcpserver.Connection) {
+			user.Set(conn, "alice")
+			SetConnValue(conn, testKey{}, 7)
+		}),
+		WithRequestHandler(func(conn tcpserver.Connection) {
+			name, ok := user.Get(conn)
+			_, otherOK := other.Get(conn)
+			fmt.Fprintf(conn, "%s %t %t %v", name, ok, otherOK, GetConnValue(conn, testKey{}))
+		}),
+	)
+	if got, want := readAll(t, dial(t, s.Addr())), "alice true false 7"; got != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+	if got, want := user.String(), "server.ConnKey(user)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}